@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+/*
+** The requests can be prefixed with an API version segment (i.e. "POST /v1/hash" or "GET /v2/hash/1") to select
+**   which set of handlers the request is dispatched to. Each version has its own verb map (the same shape as the
+**   verbHttpMap), kept in the apiVersionMap. A request without a version segment is dispatched to the
+**   DefaultApiVersion, so "POST /hash" and "POST /v1/hash" are the same request.
+**
+** The handlers registered in the verbHttpMap are the v1 handlers. Handlers for a later version are added with
+**   registerVersionedHandler(). The genericHandlerMap is shared by all of the versions.
+ */
+const ApiVersion1 = "v1"
+const DefaultApiVersion = ApiVersion1
+
+var apiVersionMap = map[string]map[string]map[string]func(http.ResponseWriter, *http.Request){
+	ApiVersion1: verbHttpMap,
+}
+
+var apiVersionSegment = regexp.MustCompile(`^v[0-9]+$`)
+
+/*
+** This is used to register a handler for the verb and method under the API version. The verb map for the version
+**   is created the first time a handler is registered for it.
+ */
+func registerVersionedHandler(version string, verb string, method string,
+	versionedHandler func(http.ResponseWriter, *http.Request)) {
+	verbMap := apiVersionMap[version]
+	if verbMap == nil {
+		verbMap = make(map[string]map[string]func(http.ResponseWriter, *http.Request))
+		apiVersionMap[version] = verbMap
+	}
+
+	handlerMap := verbMap[verb]
+	if handlerMap == nil {
+		handlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
+		verbMap[verb] = handlerMap
+	}
+
+	handlerMap[method] = versionedHandler
+}
+
+/*
+** Returns the API version the request is for and the request that is passed on to the handlers. If the path starts
+**   with a version segment, it is stripped from the URL of the returned request so the handlers parse the path the
+**   same way with or without the version (the original request is not modified). A version segment that does not
+**   match a registered version returns false.
+ */
+func splitApiVersion(r *http.Request) (string, *http.Request, bool) {
+	methodStrings := strings.SplitN(r.URL.Path, "/", 3)
+	if len(methodStrings) < 2 || !apiVersionSegment.MatchString(methodStrings[1]) {
+		return DefaultApiVersion, r, true
+	}
+
+	version := methodStrings[1]
+	if _, found := apiVersionMap[version]; !found {
+		return version, r, false
+	}
+
+	unversioned := r.WithContext(r.Context())
+	url := *r.URL
+	url.Path = strings.TrimPrefix(r.URL.Path, "/"+version)
+	if url.Path == "" {
+		url.Path = "/"
+	}
+	url.RawPath = ""
+	unversioned.URL = &url
+
+	return version, unversioned, true
+}
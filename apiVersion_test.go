@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+/*
+** A handler registered for v2 is only used for the /v2 requests, while the unversioned and /v1 requests keep going to
+**   the v1 handlers.
+ */
+func TestApiVersionDispatch(t *testing.T) {
+	registerVersionedHandler("v2", HttpGetVerb, StatsMethod, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "v2 %s", r.URL.Path)
+	})
+	t.Cleanup(func() { delete(apiVersionMap, "v2") })
+
+	w := request(http.MethodGet, "/v2/stats", "")
+	if w.Code != http.StatusOK || w.Body.String() != "v2 /stats" {
+		t.Errorf("GET /v2/stats: status %d, body %q, want the v2 handler", w.Code, w.Body.String())
+	}
+
+	for _, target := range []string{"/stats", "/v1/stats"} {
+		w := request(http.MethodGet, target, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("GET %s: status %d, body %q, want the v1 handler", target, w.Code, w.Body.String())
+		}
+	}
+
+	// v2 only has GET /stats
+	if w := request(http.MethodGet, "/v2/capabilities", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /v2/capabilities: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := request(http.MethodPost, "/v2/hash", "password=angryMonkey"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /v2/hash: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// a version that has no handlers
+	if w := request(http.MethodGet, "/v3/stats", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /v3/stats: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
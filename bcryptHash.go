@@ -0,0 +1,92 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+** By default each hash is a single SHA-2 digest of the salt, the password and the pepper (see computeHash()). That
+**   is fast to compute, which is exactly what an offline attack on a copy of the hashes wants. The -hash-scheme flag
+**   can select bcrypt instead, which has a work factor (set via the -bcrypt-cost flag) that makes every guess
+**   expensive.
+** The hashScheme is the algorithm used when a POST /hash does not have an "algo" field, and "bcrypt" is only
+**   accepted as an algo when it is the hashScheme. The bcrypt output embeds its own salt and cost, so the whole
+**   encoded string ("$2a$10$...") is saved as the digest (without a separate salt) and GET /hash/<identifier>
+**   returns it as is rather than base64 encoded.
+** bcrypt only uses the first BcryptMaxInputLength bytes of its input, so a password that is too long to be hashed
+**   along with the pepper is rejected with PRECONDITION_FAILED_412 rather than being silently truncated.
+ */
+const BcryptHashAlgorithm = "bcrypt"
+const BcryptMaxInputLength = 72
+
+var hashScheme = DefaultHashAlgorithm
+var bcryptCost = bcrypt.DefaultCost
+
+/*
+** The right bcryptCost depends on the hardware, so when bcryptCalibrateMs is set (via the -bcrypt-calibrate-ms
+**   flag, 0 disables it) the cost is picked at startup by calibrateBcryptCost() instead, and the -bcrypt-cost flag is
+**   ignored. The chosen cost is logged.
+ */
+var bcryptCalibrateMs = 0
+
+/*
+** Returns true if the algorithm can be used for a new hash.
+ */
+func isHashAlgorithmEnabled(algorithm string) bool {
+	if algorithm == BcryptHashAlgorithm {
+		return hashScheme == BcryptHashAlgorithm
+	}
+
+	_, found := hashAlgorithms[algorithm]
+	return found
+}
+
+/*
+** Returns true if the password (followed by the pepper) is short enough to be hashed with bcrypt.
+ */
+func fitsBcryptInput(password string) bool {
+	return len(password)+len(currentPepper()) <= BcryptMaxInputLength
+}
+
+/*
+** Returns the bcrypt encoded hash of the password followed by the pepper, using the bcryptCost.
+ */
+func computeBcryptHash(password string, pepper []byte) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(append([]byte(password), pepper...), bcryptCost)
+}
+
+/*
+** Returns true if the bcrypt encoded hash is the hash of the password followed by the pepper.
+ */
+func matchesBcryptHash(digest []byte, password string, pepper []byte) bool {
+	return bcrypt.CompareHashAndPassword(digest, append([]byte(password), pepper...)) == nil
+}
+
+/*
+** Returns the highest bcrypt cost whose hash takes no longer than the target on this machine (or bcrypt.MinCost if
+**   even that takes longer). The costs are timed in increasing order. Each step up doubles the time of the hash, so
+**   the timing stops as soon as the next cost would clearly be over the target rather than running it.
+ */
+func calibrateBcryptCost(target time.Duration) int {
+	cost := bcrypt.MinCost
+
+	for next := bcrypt.MinCost; next <= bcrypt.MaxCost; next++ {
+		start := time.Now()
+		if _, err := bcrypt.GenerateFromPassword([]byte("calibrate"), next); err != nil {
+			break
+		}
+		elapsed := time.Since(start)
+
+		if elapsed > target {
+			break
+		}
+		cost = next
+		if 2*elapsed > target {
+			break
+		}
+	}
+
+	return cost
+}
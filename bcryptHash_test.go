@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+** With -hash-scheme=bcrypt, POST /hash is hashed with bcrypt at the -bcrypt-cost. GET /hash/<identifier> returns
+**   the encoded bcrypt string (with no separate salt) and POST /hash/verify matches only the hashed password.
+ */
+func TestBcryptHashScheme(t *testing.T) {
+	setForTest(t, &hashScheme, BcryptHashAlgorithm)
+	setForTest(t, &bcryptCost, bcrypt.MinCost)
+	setForTest(t, &hashDelay, 0)
+
+	identifier := postHash(t, "password=angryMonkey")
+	hashed := hashedResponse(t, waitForHashed(t, identifier))
+	if hashed.Salt != "" || !strings.HasPrefix(hashed.Hash, "$2a$04$") {
+		t.Fatalf("GET /hash/%s: salt %q and hash %q, want a cost 4 bcrypt hash", identifier, hashed.Salt, hashed.Hash)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashed.Hash), []byte("angryMonkey")); err != nil {
+		t.Errorf("the bcrypt hash does not match the password: %v", err)
+	}
+
+	var metadata hashMetadataResponse
+	w := request(http.MethodGet, "/hash/"+identifier+"?format=json", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil || metadata.Algorithm != BcryptHashAlgorithm ||
+		metadata.Hash != hashed.Hash {
+		t.Errorf("GET /hash/%s?format=json: body %q, want the bcrypt algo and hash", identifier, w.Body.String())
+	}
+
+	for password, want := range map[string]string{"angryMonkey": `{"match":true}`, "happyMonkey": `{"match":false}`} {
+		w := request(http.MethodPost, "/hash/verify", "id="+identifier+"&password="+password)
+		if strings.TrimSpace(w.Body.String()) != want {
+			t.Errorf("POST /hash/verify with %s: body %q, want %s", password, w.Body.String(), want)
+		}
+	}
+
+	// The SHA-2 algorithms can still be selected with the algo field
+	identifier = postHash(t, "password=angryMonkey&algo=sha256")
+	if hashed := hashedResponse(t, waitForHashed(t, identifier)); hashed.Salt == "" {
+		t.Errorf("GET /hash/%s with algo=sha256: no salt", identifier)
+	}
+}
+
+/*
+** bcrypt is only accepted as an algo when it is the -hash-scheme, and a password that bcrypt would truncate is
+**   rejected with PRECONDITION_FAILED_412.
+ */
+func TestBcryptHashSchemeRejects(t *testing.T) {
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey&algo=bcrypt"); w.Code !=
+		http.StatusUnprocessableEntity {
+		t.Errorf("POST /hash with algo=bcrypt and the default scheme: status %d, want %d", w.Code,
+			http.StatusUnprocessableEntity)
+	}
+
+	setForTest(t, &hashScheme, BcryptHashAlgorithm)
+	password := strings.Repeat("a", BcryptMaxInputLength+1)
+	if w := request(http.MethodPost, "/hash", "password="+password); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST /hash with a %d byte password: status %d, want %d", len(password), w.Code,
+			http.StatusPreconditionFailed)
+	}
+}
+
+/*
+** The calibrated cost is the highest one that hashes within the target, so a short target gives a low cost (never
+**   below bcrypt.MinCost, even when no cost is fast enough).
+ */
+func TestCalibrateBcryptCost(t *testing.T) {
+	if cost := calibrateBcryptCost(time.Nanosecond); cost != bcrypt.MinCost {
+		t.Errorf("calibrated cost %d for a 1ns target, want %d", cost, bcrypt.MinCost)
+	}
+
+	// Even a fast machine takes far longer than 20ms at a cost of 12 (256 times the work of the MinCost)
+	target := 20 * time.Millisecond
+	cost := calibrateBcryptCost(target)
+	if cost < bcrypt.MinCost || cost >= 12 {
+		t.Fatalf("calibrated cost %d for a %v target, want from %d to 11", cost, target, bcrypt.MinCost)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+** The following is used to detect clients that are sending an abusive amount of request body data. The number of
+**   body bytes read from each client IP is accumulated over a fixed window (-bytes-per-ip-window). Once a client
+**   has sent more than -max-bytes-per-ip-window bytes in the current window, it is logged and the rest of its
+**   requests in the window are rejected with TOO_MANY_REQUESTS_429. A maximum of 0 turns the check off.
+** The bodyBytesMutex protects the bodyBytesByIP map.
+ */
+var maxBytesPerIPWindow int64 = 0
+var bytesPerIPWindow = time.Minute
+
+type bodyBytesWindow struct {
+	start   time.Time
+	bytes   int64
+	flagged bool
+}
+
+var bodyBytesMutex sync.Mutex
+var bodyBytesByIP = make(map[string]*bodyBytesWindow)
+var lastBodyBytesPrune time.Time
+
+/*
+** Once the map has more than BodyBytesPruneThreshold entries, the entries whose window has expired are removed. The
+**   scan runs at most once per window (since no entry can expire sooner), so a steady stream of new clients does
+**   not scan the whole map on every request. The map never holds more than MaxBodyBytesEntries: when it is full, an
+**   arbitrary entry is dropped to make room for the new client.
+ */
+const BodyBytesPruneThreshold = 1024
+const MaxBodyBytesEntries = 65536
+
+/*
+** The countingReader wraps the request body to count the number of bytes that the handler actually reads.
+ */
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+/*
+** Returns true if the client has already exceeded the body bytes allowed in the current window.
+ */
+func bodyBytesExceeded(ip string, now time.Time) bool {
+	if maxBytesPerIPWindow <= 0 {
+		return false
+	}
+
+	bodyBytesMutex.Lock()
+	defer bodyBytesMutex.Unlock()
+
+	window := bodyBytesByIP[ip]
+	return window != nil && now.Sub(window.start) < bytesPerIPWindow && window.bytes > maxBytesPerIPWindow
+}
+
+/*
+** Adds the number of body bytes read for the request to the client's current window.
+ */
+func recordBodyBytes(ip string, bytes int64, now time.Time) {
+	if maxBytesPerIPWindow <= 0 || bytes == 0 {
+		return
+	}
+
+	bodyBytesMutex.Lock()
+	defer bodyBytesMutex.Unlock()
+
+	window := bodyBytesByIP[ip]
+	if window == nil || now.Sub(window.start) >= bytesPerIPWindow {
+		if len(bodyBytesByIP) > BodyBytesPruneThreshold && now.Sub(lastBodyBytesPrune) >= bytesPerIPWindow {
+			pruneBodyBytesWindows(now)
+			lastBodyBytesPrune = now
+		}
+		if bodyBytesByIP[ip] == nil && len(bodyBytesByIP) >= MaxBodyBytesEntries {
+			for other := range bodyBytesByIP {
+				delete(bodyBytesByIP, other)
+				break
+			}
+		}
+		window = &bodyBytesWindow{start: now}
+		bodyBytesByIP[ip] = window
+	}
+
+	window.bytes += bytes
+	if window.bytes > maxBytesPerIPWindow && !window.flagged {
+		window.flagged = true
+		log.Printf("recordBodyBytes: client %s sent %d body bytes in %s (limit %d)", ip, window.bytes,
+			bytesPerIPWindow, maxBytesPerIPWindow)
+	}
+}
+
+/*
+** Removes the windows that have expired. This must be called with the bodyBytesMutex held.
+ */
+func pruneBodyBytesWindows(now time.Time) {
+	for ip, window := range bodyBytesByIP {
+		if now.Sub(window.start) >= bytesPerIPWindow {
+			delete(bodyBytesByIP, ip)
+		}
+	}
+}
+
+/*
+** This is called by the central handler prior to dispatching the request. If the client has exceeded its body
+**   bytes for the window, the TOO_MANY_REQUESTS_429 response is written and nil is returned. Otherwise, the request
+**   body is wrapped so the bytes read can be counted, and the returned function must be called once the handler
+**   has completed to record them.
+ */
+func accountBodyBytes(w http.ResponseWriter, r *http.Request) func() {
+	if maxBytesPerIPWindow <= 0 {
+		return func() {}
+	}
+
+	ip := clientIP(r)
+	if bodyBytesExceeded(ip, time.Now()) {
+		// TOO_MANY_REQUESTS_429
+		writeError(w, http.StatusTooManyRequests, "request body limit exceeded")
+		return nil
+	}
+
+	counter := &countingReader{ReadCloser: r.Body}
+	r.Body = counter
+
+	return func() {
+		recordBodyBytes(ip, counter.bytes, time.Now())
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Starts the test with an empty bodyBytesByIP map and the limit set to the maximum.
+ */
+func setBodyBytesLimitForTest(t *testing.T, maximum int64) {
+	t.Helper()
+
+	setForTest(t, &maxBytesPerIPWindow, maximum)
+	setForTest(t, &bodyBytesByIP, make(map[string]*bodyBytesWindow))
+	setForTest(t, &lastBodyBytesPrune, time.Time{})
+}
+
+/*
+** Once a client has sent more than the limit, its requests are rejected until the window ends.
+ */
+func TestBodyBytesLimit(t *testing.T) {
+	setBodyBytesLimitForTest(t, 32)
+
+	body := "password=" + strings.Repeat("a", 30)
+	if w := request(http.MethodPost, "/hash", body); w.Code != http.StatusOK {
+		t.Fatalf("first POST /hash: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := request(http.MethodPost, "/hash", body); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second POST /hash: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// once the window has ended, the client can send again
+	bodyBytesMutex.Lock()
+	for _, window := range bodyBytesByIP {
+		window.start = window.start.Add(-bytesPerIPWindow)
+	}
+	bodyBytesMutex.Unlock()
+	if w := request(http.MethodPost, "/hash", body); w.Code != http.StatusOK {
+		t.Errorf("POST /hash in the next window: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** The expired windows are pruned at most once per window, and the map never holds more than MaxBodyBytesEntries.
+ */
+func TestBodyBytesMapIsBounded(t *testing.T) {
+	setBodyBytesLimitForTest(t, 1000)
+
+	now := time.Now()
+	for i := 0; i < MaxBodyBytesEntries+100; i++ {
+		recordBodyBytes(fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff), 1, now)
+	}
+	if len(bodyBytesByIP) != MaxBodyBytesEntries {
+		t.Errorf("%d entries, want %d", len(bodyBytesByIP), MaxBodyBytesEntries)
+	}
+
+	// all of the windows have expired, so the next new client prunes them
+	later := now.Add(bytesPerIPWindow)
+	recordBodyBytes("192.0.2.1", 1, later)
+	if len(bodyBytesByIP) != 1 || !lastBodyBytesPrune.Equal(later) {
+		t.Errorf("after the prune: %d entries (want 1), last prune %v (want %v)", len(bodyBytesByIP),
+			lastBodyBytesPrune, later)
+	}
+}
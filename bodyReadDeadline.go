@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+** The bodyReadTimeout (set via the -body-read-timeout flag) is used to defend against clients that trickle the
+**   request body to tie up the server. Prior to each read of the body, the read deadline on the connection is moved
+**   to bodyReadTimeout in the future, so a client that stalls for longer than that in the middle of the body has its
+**   request failed with REQUEST_TIMEOUT_408 and the connection closed. A timeout of 0 turns the check off.
+ */
+var bodyReadTimeout time.Duration = 0
+
+/*
+** The deadlineReader wraps the request body so that the connection read deadline is set prior to every read.
+ */
+type deadlineReader struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	timedOut   bool
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if err := d.controller.SetReadDeadline(time.Now().Add(bodyReadTimeout)); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "deadlineReader.Read() SetReadDeadline: %v\n", err)
+	}
+	n, err := d.ReadCloser.Read(p)
+	if isBodyReadTimeout(err) {
+		d.timedOut = true
+	}
+	return n, err
+}
+
+/*
+** This wraps the request body with the deadlineReader. The returned function must be called once the body has been
+**   read to clear the read deadline so that it does not apply to the next request on the connection. If the deadline
+**   expired, it is left in place so the http server does not block trying to drain the rest of the body before it
+**   closes the connection.
+ */
+func applyBodyReadDeadline(w http.ResponseWriter, r *http.Request) func() {
+	if bodyReadTimeout <= 0 {
+		return func() {}
+	}
+
+	controller := http.NewResponseController(w)
+	reader := &deadlineReader{ReadCloser: r.Body, controller: controller}
+	r.Body = reader
+
+	return func() {
+		if !reader.timedOut {
+			_ = controller.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+/*
+** Returns true if the error is from the read deadline expiring while reading the request body.
+ */
+func isBodyReadTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
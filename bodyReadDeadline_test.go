@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Sends a POST /hash to the server that trickles the body: each piece is written after the pause.
+ */
+func trickleHashRequest(t *testing.T, address string, pieces []string, pause time.Duration) (net.Conn, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "POST /hash HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\n\r\n", len(strings.Join(pieces, "")))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for _, piece := range pieces {
+		time.Sleep(pause)
+		if _, err := io.WriteString(conn, piece); err != nil {
+			break
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+	return conn, response
+}
+
+/*
+** With -body-read-timeout, a POST /hash whose body stalls for longer than the timeout is failed with
+**   REQUEST_TIMEOUT_408 and its connection is closed. A body that keeps arriving within the timeout is hashed.
+ */
+func TestBodyReadTimeout(t *testing.T) {
+	setForTest(t, &bodyReadTimeout, 100*time.Millisecond)
+	server := httptest.NewServer(securityHeaders(requireSignature(handler)))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	conn, response := trickleHashRequest(t, address, []string{"password=", "angryMonkey"}, 300*time.Millisecond)
+	if response.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("stalled body: status %d, want %d", response.StatusCode, http.StatusRequestTimeout)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("stalled body: the connection was left open")
+	}
+
+	_, response = trickleHashRequest(t, address, []string{"pass", "word=", "angry", "Monkey"}, 20*time.Millisecond)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("trickled body within the timeout: status %d, want %d", response.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+** The debug endpoints (FeatureDebug) are only enabled when the server is started with the -debug flag. When the flag
+**   is not set, any request to /debug/... is handled the same as any other unsupported method.
+ */
+var debugEndpointsEnabled = false
+
+/*
+** The following are the supported sub-methods under the /debug method
+ */
+const DebugRequestsMethod = "requests"
+const DebugEchoMethod = "echo"
+
+/*
+** The values of these headers are replaced with RedactedHeaderValue in the GET /debug/echo response so that
+**   credentials are not reflected back.
+ */
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", SignatureHeader}
+
+const RedactedHeaderValue = "[REDACTED]"
+
+/*
+** The echoResponse is what is returned by GET /debug/echo. It is what the server actually received, which is used
+**   to debug what the proxies in front of the server are doing to the requests.
+ */
+type echoResponse struct {
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	Headers  map[string][]string `json:"headers"`
+	ClientIP string              `json:"client_ip"`
+}
+
+/*
+** The number of request summaries kept in the ring buffer. Once the buffer is full, the oldest summary is
+**   overwritten so the memory used for debugging is bounded.
+ */
+const RequestSummaryBufferSize = 64
+
+/*
+** A requestSummary is what is captured for each request that goes through the central handler. Only the path is
+**   kept (not the query string or the form data) so that passwords passed to POST /hash are never captured.
+ */
+type requestSummary struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Status     int    `json:"status"`
+	DurationUs int64  `json:"duration_us"`
+	ClientIP   string `json:"client_ip"`
+}
+
+/*
+** The ring buffer of request summaries. The summaryMutex protects the buffer, the next slot to write and the number
+**   of valid entries.
+ */
+var summaryMutex sync.Mutex
+var requestSummaries [RequestSummaryBufferSize]requestSummary
+var nextSummary = 0
+var validSummaries = 0
+
+/*
+** The statusRecorder wraps the http.ResponseWriter passed into the central handler so that the status code that
+**   the sub-handler responded with (and the number of body bytes it wrote) can be captured. If the sub-handler
+**   never calls WriteHeader(), the status is the implicit OK_200 that the http server sends with the first write.
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.wroteHeader = true
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows the http.ResponseController to reach the underlying connection (i.e. to set the read deadline)
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+/*
+** Returns the IP address of the client that sent the request. The RemoteAddr is in the form "host:port", so the
+**   port needs to be stripped off.
+ */
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+** This is called by the central handler once the sub-handler has completed to save the summary of the request in
+**   the ring buffer. Nothing is recorded unless the debug endpoints are enabled.
+ */
+func recordRequestSummary(r *http.Request, status int, start time.Time) {
+	if !features.Enabled(FeatureDebug) {
+		return
+	}
+
+	summary := requestSummary{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		DurationUs: time.Since(start).Microseconds(),
+		ClientIP:   clientIP(r),
+	}
+
+	summaryMutex.Lock()
+	requestSummaries[nextSummary] = summary
+	nextSummary = (nextSummary + 1) % RequestSummaryBufferSize
+	if validSummaries < RequestSummaryBufferSize {
+		validSummaries++
+	}
+	summaryMutex.Unlock()
+}
+
+/*
+** This is the handler for the GET /debug/<sub-method> requests. If the debug endpoints are not enabled, this behaves
+**   exactly like any other unsupported method.
+ */
+func debug(w http.ResponseWriter, r *http.Request) {
+	if !features.Enabled(FeatureDebug) {
+		unsupportedRequest(w, r)
+		return
+	}
+
+	methodStrings := strings.Split(r.URL.Path, "/")
+	if len(methodStrings) == 3 && methodStrings[2] == DebugRequestsMethod {
+		returnRequestSummaries(w)
+	} else if len(methodStrings) == 3 && methodStrings[2] == DebugEchoMethod {
+		echoRequest(w, r)
+	} else {
+		unsupportedRequest(w, r)
+	}
+}
+
+/*
+** Returns the request summaries in the ring buffer as a JSON array, oldest first.
+ */
+func returnRequestSummaries(w http.ResponseWriter) {
+	summaryMutex.Lock()
+	summaries := make([]requestSummary, 0, validSummaries)
+	first := (nextSummary - validSummaries + RequestSummaryBufferSize) % RequestSummaryBufferSize
+	for i := 0; i < validSummaries; i++ {
+		summaries = append(summaries, requestSummaries[(first+i)%RequestSummaryBufferSize])
+	}
+	summaryMutex.Unlock()
+
+	if err := writeJSON(w, http.StatusOK, summaries); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "returnRequestSummaries() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** Returns the method, path, headers (with the sensitive ones redacted) and client IP of the request as JSON.
+ */
+func echoRequest(w http.ResponseWriter, r *http.Request) {
+	headers := r.Header.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := headers[name]; ok {
+			headers[name] = []string{RedactedHeaderValue}
+		}
+	}
+
+	response := echoResponse{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Headers:  headers,
+		ClientIP: clientIP(r),
+	}
+
+	if err := writeJSON(w, http.StatusOK, response); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "echoRequest() writeJSON: %v\n", err)
+	}
+}
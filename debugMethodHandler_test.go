@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+** Starts the test with the debug endpoints enabled and an empty ring buffer of request summaries.
+ */
+func enableDebugForTest(t *testing.T) {
+	t.Helper()
+
+	setFeatureForTest(t, FeatureDebug, true)
+
+	summaryMutex.Lock()
+	originalSummaries, originalNext, originalValid := requestSummaries, nextSummary, validSummaries
+	requestSummaries, nextSummary, validSummaries = [RequestSummaryBufferSize]requestSummary{}, 0, 0
+	summaryMutex.Unlock()
+	t.Cleanup(func() {
+		summaryMutex.Lock()
+		requestSummaries, nextSummary, validSummaries = originalSummaries, originalNext, originalValid
+		summaryMutex.Unlock()
+	})
+}
+
+/*
+** Returns the summaries from GET /debug/requests.
+ */
+func getRequestSummaries(t *testing.T) []requestSummary {
+	t.Helper()
+
+	w := request(http.MethodGet, "/debug/requests", "")
+	var summaries []requestSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("GET /debug/requests: status %d, body %q: %v", w.Code, w.Body.String(), err)
+	}
+	return summaries
+}
+
+/*
+** The requests are read back from GET /debug/requests, oldest first, without their query strings or bodies.
+ */
+func TestDebugRequests(t *testing.T) {
+	enableDebugForTest(t)
+
+	request(http.MethodPost, "/hash?password=angryMonkey", "")
+	request(http.MethodGet, "/stats", "")
+	request(http.MethodGet, "/missing", "")
+
+	summaries := getRequestSummaries(t)
+	want := []requestSummary{
+		{Method: http.MethodPost, Path: "/hash", Status: http.StatusOK},
+		{Method: http.MethodGet, Path: "/stats", Status: http.StatusOK},
+		{Method: http.MethodGet, Path: "/missing", Status: http.StatusMethodNotAllowed},
+	}
+	if len(summaries) != len(want) {
+		t.Fatalf("%d summaries, want %d: %+v", len(summaries), len(want), summaries)
+	}
+	for i, summary := range summaries {
+		if summary.Method != want[i].Method || summary.Path != want[i].Path || summary.Status != want[i].Status ||
+			summary.ClientIP == "" {
+			t.Errorf("summary %d: %+v, want %+v", i, summary, want[i])
+		}
+	}
+}
+
+/*
+** The ring buffer keeps only the most recent RequestSummaryBufferSize requests.
+ */
+func TestDebugRequestsIsBounded(t *testing.T) {
+	enableDebugForTest(t)
+
+	for i := 0; i < RequestSummaryBufferSize+5; i++ {
+		request(http.MethodGet, fmt.Sprintf("/hash/%d", 1000000+i), "")
+	}
+
+	summaries := getRequestSummaries(t)
+	if len(summaries) != RequestSummaryBufferSize {
+		t.Fatalf("%d summaries, want %d", len(summaries), RequestSummaryBufferSize)
+	}
+	if first := summaries[0].Path; first != "/hash/1000005" {
+		t.Errorf("oldest summary %q, want /hash/1000005", first)
+	}
+}
+
+/*
+** GET /debug/echo redacts the credentials, and the debug endpoints are unsupported without -debug.
+ */
+func TestDebugEcho(t *testing.T) {
+	enableDebugForTest(t)
+
+	r := newRequest(http.MethodGet, "/debug/echo", "")
+	r.Header.Set("Authorization", "Bearer s3cret")
+	w := serve(r)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "s3cret") ||
+		!strings.Contains(w.Body.String(), RedactedHeaderValue) {
+		t.Errorf("GET /debug/echo: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	features.Set(FeatureDebug, false)
+	if w := request(http.MethodGet, "/debug/requests", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /debug/requests without -debug: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+** GET /debug/echo reflects back the method, path and headers the server received along with the client IP taken
+**   from the address of the connection.
+ */
+func TestDebugEchoReflectsRequest(t *testing.T) {
+	enableDebugForTest(t)
+
+	r := newRequest(http.MethodGet, "/v1/debug/echo?trace=1", "")
+	r.RemoteAddr = "203.0.113.7:52100"
+	r.Header.Set("X-Trace-Id", "trace-1234")
+	w := serve(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /debug/echo: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	var echo echoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+		t.Fatalf("GET /debug/echo: body %q: %v", w.Body.String(), err)
+	}
+	if echo.Method != http.MethodGet || echo.Path != "/debug/echo" || echo.ClientIP != "203.0.113.7" {
+		t.Errorf("GET /debug/echo: method %q, path %q and client IP %q, want GET, /debug/echo and 203.0.113.7",
+			echo.Method, echo.Path, echo.ClientIP)
+	}
+	if value := echo.Headers["X-Trace-Id"]; len(value) != 1 || value[0] != "trace-1234" {
+		t.Errorf("GET /debug/echo: X-Trace-Id %v, want trace-1234", value)
+	}
+}
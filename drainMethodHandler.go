@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+/*
+** The drainingMethods map is used to stop accepting writes to specific methods while leaving the rest of the
+**   server running (i.e. during a partial degradation). While a method is draining, any request to it with a
+**   verb other than GET is responded to with SERVICE_UNAVAILABLE_503, but the GET requests for the method (the
+**   reads) continue to work. The drainMutex protects access to the map.
+** The sub-paths in the drainExemptPaths do not write anything even though they are not GET requests (i.e.
+**   POST /hash/verify only checks a password against a saved hash), so they keep working while their method drains.
+**
+**   POST /drain?method=<method> - start draining the method
+**   POST /resume?method=<method> - stop draining the method
+ */
+var drainMutex sync.Mutex
+var drainingMethods = make(map[string]bool)
+
+const DrainMethod = "drain"
+const ResumeMethod = "resume"
+const DrainMethodQueryParam = "method"
+
+var drainExemptPaths = map[string]map[string]bool{
+	HashMethod: {HashVerifyMethod: true},
+}
+
+/*
+** The drainResponse is what is returned by POST /drain and POST /resume
+ */
+type drainResponse struct {
+	Method   string `json:"method"`
+	Draining bool   `json:"draining"`
+}
+
+/*
+** Returns true if the method is currently draining. The path is the rest of the path after the method (i.e. "verify"
+**   for /hash/verify), and an exempt path is never draining.
+ */
+func isMethodDraining(method string, path string) bool {
+	if drainExemptPaths[method][path] {
+		return false
+	}
+
+	drainMutex.Lock()
+	draining := drainingMethods[method]
+	drainMutex.Unlock()
+
+	return draining
+}
+
+/*
+** This is the handler for the POST /drain request.
+ */
+func drain(w http.ResponseWriter, r *http.Request) {
+	setMethodDraining(w, r, true)
+}
+
+/*
+** This is the handler for the POST /resume request.
+ */
+func resume(w http.ResponseWriter, r *http.Request) {
+	setMethodDraining(w, r, false)
+}
+
+/*
+** Sets or clears the draining flag for the method passed in the "method" query parameter. The method must be one
+**   that is registered for the POST verb (and cannot be /drain or /resume themselves, otherwise there would be no
+**   way to undo it). An unknown method is responded to with UNPROCESSABLE_ENTITY_422.
+ */
+func setMethodDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	method := r.URL.Query().Get(DrainMethodQueryParam)
+	if method == "" || method == DrainMethod || method == ResumeMethod || postHandlerMap[method] == nil {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "")
+		return
+	}
+
+	drainMutex.Lock()
+	if draining {
+		drainingMethods[method] = true
+	} else {
+		delete(drainingMethods, method)
+	}
+	drainMutex.Unlock()
+
+	// OK_200
+	if err := writeJSON(w, http.StatusOK, drainResponse{Method: method, Draining: draining}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "setMethodDraining() writeJSON: %v\n", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+** Draining /hash stops the new hashes, but the reads (GET /hash/<identifier> and POST /hash/verify) keep working.
+ */
+func TestDrainHashKeepsVerify(t *testing.T) {
+	setForTest(t, &hashDelay, 0)
+
+	identifier := postHash(t, "password=angryMonkey")
+	if w := waitForHashed(t, identifier); w.Code != http.StatusOK {
+		t.Fatalf("GET /hash/%s: status %d", identifier, w.Code)
+	}
+
+	if w := request(http.MethodPost, "/drain?method=hash", ""); w.Code != http.StatusOK {
+		t.Fatalf("POST /drain: status %d, body %q", w.Code, w.Body.String())
+	}
+	t.Cleanup(func() { request(http.MethodPost, "/resume?method=hash", "") })
+
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /hash while draining: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w := request(http.MethodPost, "/hash/verify", "id="+identifier+"&password=angryMonkey")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"match":true`) {
+		t.Errorf("POST /hash/verify while draining: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	if w := request(http.MethodGet, "/hash/"+identifier, ""); w.Code != http.StatusOK {
+		t.Errorf("GET /hash/%s while draining: status %d", identifier, w.Code)
+	}
+
+	if w := request(http.MethodPost, "/resume?method=hash", ""); w.Code != http.StatusOK {
+		t.Fatalf("POST /resume: status %d", w.Code)
+	}
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusOK {
+		t.Errorf("POST /hash after the resume: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
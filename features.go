@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+** The features registry is the single place that records which of the optional features are enabled. The handlers
+**   check features.Enabled(<feature>) rather than the individual flag variables, and GET /capabilities renders the
+**   whole registry. The registry is filled in from the flags by initializeFeatures() (called from initialize()), and
+**   a feature can be toggled at runtime with features.Set().
+ */
+const FeatureDebug = "debug"
+const FeatureGzip = "gzip"
+const FeatureJwt = "jwt"
+const FeaturePepper = "pepper"
+const FeatureReadOnly = "read_only"
+const FeatureTLS = "tls"
+
+type featureRegistry struct {
+	mutex   sync.RWMutex
+	enabled map[string]bool
+}
+
+var features = &featureRegistry{
+	enabled: map[string]bool{
+		FeatureDebug:    false,
+		FeatureGzip:     true,
+		FeatureJwt:      false,
+		FeaturePepper:   false,
+		FeatureReadOnly: false,
+		FeatureTLS:      false,
+	},
+}
+
+/*
+** Returns true if the feature is enabled. A feature that is not in the registry is never enabled.
+ */
+func (f *featureRegistry) Enabled(feature string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.enabled[feature]
+}
+
+/*
+** Enables or disables the feature (adding it to the registry if it is not already there).
+ */
+func (f *featureRegistry) Set(feature string, enabled bool) {
+	f.mutex.Lock()
+	f.enabled[feature] = enabled
+	f.mutex.Unlock()
+}
+
+/*
+** Returns a copy of the registry.
+ */
+func (f *featureRegistry) Snapshot() map[string]bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	snapshot := make(map[string]bool, len(f.enabled))
+	for feature, enabled := range f.enabled {
+		snapshot[feature] = enabled
+	}
+
+	return snapshot
+}
+
+/*
+** Returns the names of the features that are enabled, sorted.
+ */
+func (f *featureRegistry) EnabledNames() []string {
+	names := []string{}
+	for feature, enabled := range f.Snapshot() {
+		if enabled {
+			names = append(names, feature)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+/*
+** This sets the features from the flags that control them.
+ */
+func initializeFeatures() {
+	features.Set(FeatureDebug, debugEndpointsEnabled)
+	features.Set(FeatureJwt, jwtKey != "")
+	features.Set(FeaturePepper, pepperFile != "")
+	features.Set(FeatureReadOnly, readOnlyMode)
+	features.Set(FeatureTLS, tlsCertFile != "" && tlsKeyFile != "")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+/*
+** Sets the feature in the registry for the duration of the test.
+ */
+func setFeatureForTest(t *testing.T, feature string, enabled bool) {
+	t.Helper()
+
+	original := features.Enabled(feature)
+	features.Set(feature, enabled)
+	t.Cleanup(func() { features.Set(feature, original) })
+}
+
+/*
+** Returns the GET /capabilities response.
+ */
+func getCapabilities(t *testing.T) capabilitiesResponse {
+	t.Helper()
+
+	w := request(http.MethodGet, "/capabilities", "")
+	var response capabilitiesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET /capabilities: status %d, body %q: %v", w.Code, w.Body.String(), err)
+	}
+	return response
+}
+
+/*
+** Toggling a feature in the registry changes both the behavior of the handlers and the GET /capabilities output.
+ */
+func TestFeatureToggle(t *testing.T) {
+	setFeatureForTest(t, FeatureReadOnly, true)
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /hash in read-only mode: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if capabilities := getCapabilities(t); !capabilities.ReadOnly || !capabilities.Features[FeatureReadOnly] {
+		t.Errorf("GET /capabilities in read-only mode: read_only %t, features %v", capabilities.ReadOnly,
+			capabilities.Features)
+	}
+
+	features.Set(FeatureReadOnly, false)
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusOK {
+		t.Errorf("POST /hash after read-only mode: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if capabilities := getCapabilities(t); capabilities.ReadOnly || capabilities.Features[FeatureReadOnly] {
+		t.Errorf("GET /capabilities after read-only mode: read_only %t, features %v", capabilities.ReadOnly,
+			capabilities.Features)
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/notterness/go_server
+
+go 1.26.0
+
+require golang.org/x/crypto v0.57.0
+
+require golang.org/x/sync v0.23.0
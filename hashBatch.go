@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+** POST /hash/batch hashes several passwords with a single request. The passwords are the repeated "password" form
+**   fields (at most MaxBatchPasswords of them) and the optional "algo" field applies to all of them. Each password is
+**   handed its own identifier, in the order the passwords appear in the request, and the response is
+**   {"ids":["1","2",...]}. The batches are not included in the GET /stats values.
+** The hashes of a batch are run by an errgroup that is limited to batchConcurrency of them at a time (set via the
+**   -batch-concurrency flag, the number of CPUs by default), so a large batch does not compute all of its hashes at
+**   once. Each hash is otherwise the same as for a POST /hash (performHash() waits the hashDelay and saves the hashed
+**   password), so the identifiers can also be read back with GET /hash/<identifier>.
+** With wait=true in the query string, the response is held until all of the hashes of the batch are done (or the
+**   hashWaitMax has passed, or the client went away) and is then {"hashes":[{"id":"1","salt":"...","hash":"..."},
+**   ...]}. An identifier without a hash has a "status" (pending, cancelled, failed or deleted) instead.
+ */
+const MaxBatchPasswords = 100
+
+var batchConcurrency = runtime.NumCPU()
+
+type batchHashResponse struct {
+	Id     string `json:"id"`
+	Salt   string `json:"salt,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
+/*
+** This is the handler for the "POST /hash/batch" request. The error responses are:
+**   PRECONDITION_FAILED_412 - a password is empty or too long (the whole batch is rejected)
+**   REQUEST_ENTITY_TOO_LARGE_413 - there are more than MaxBatchPasswords passwords
+**   UNPROCESSABLE_ENTITY_422 - the algo is not supported or wait is not a boolean
+**   INSUFFICIENT_STORAGE_507 - the identifiers ran out before all of the passwords were handed one
+ */
+func hashBatch(w http.ResponseWriter, r *http.Request) {
+	wait := false
+	if value := r.URL.Query().Get(HashWaitQueryParam); value != "" {
+		var err error
+		if wait, err = strconv.ParseBool(value); err != nil {
+			// UNPROCESSABLE_ENTITY_422
+			writeError(w, http.StatusUnprocessableEntity, "invalid wait")
+			return
+		}
+	}
+
+	if !parseHashForm(w, r, true) {
+		return
+	}
+
+	passwords := r.Form[PasswordFormField]
+	if len(passwords) > MaxBatchPasswords {
+		// REQUEST_ENTITY_TOO_LARGE_413
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("more than %d passwords", MaxBatchPasswords))
+		return
+	}
+
+	// PRECONDITION_FAILED_412 - the same checks as validateFormData() makes for a single password
+	if len(passwords) == 0 {
+		writeError(w, http.StatusPreconditionFailed, "")
+		return
+	}
+	for _, password := range passwords {
+		if password == "" || (maxPasswordLength > 0 && len(password) > maxPasswordLength) {
+			writeError(w, http.StatusPreconditionFailed, "")
+			return
+		}
+	}
+
+	algorithm := r.FormValue(AlgoFormField)
+	if algorithm == "" {
+		algorithm = hashScheme
+	}
+	if !isHashAlgorithmEnabled(algorithm) {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "unsupported algo")
+		return
+	}
+
+	// PRECONDITION_FAILED_412 - bcrypt would silently ignore the end of a longer password
+	if algorithm == BcryptHashAlgorithm {
+		for _, password := range passwords {
+			if !fitsBcryptInput(password) {
+				writeError(w, http.StatusPreconditionFailed, "password too long for bcrypt")
+				return
+			}
+		}
+	}
+
+	identifiers := make([]int64, len(passwords))
+	for i := range passwords {
+		tmp, ok := nextIdentifier()
+		if !ok {
+			// INSUFFICIENT_STORAGE_507
+			writeError(w, http.StatusInsufficientStorage, "")
+			return
+		}
+		identifiers[i] = int64(tmp)
+	}
+
+	now := time.Now()
+	for _, identifier := range identifiers {
+		pendingHashes.Add(1)
+		addPendingHash(identifier, now)
+	}
+
+	/*
+	** The errgroup is run from its own goroutine since Go() blocks once batchConcurrency hashes are running, and the
+	**   response without wait=true is not held up by that.
+	 */
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var group errgroup.Group
+		group.SetLimit(batchConcurrency)
+		for i, identifier := range identifiers {
+			password := passwords[i]
+			group.Go(func() error {
+				performHash(identifier, algorithm, password)
+				return nil
+			})
+		}
+		_ = group.Wait()
+	}()
+
+	if !wait {
+		ids := make([]string, len(identifiers))
+		for i, identifier := range identifiers {
+			ids[i] = formatIdentifier(identifier)
+		}
+		if err := writeJSON(w, http.StatusOK, map[string][]string{"ids": ids}); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "hashBatch(1) writeJSON: %v\n", err)
+		}
+		return
+	}
+
+	if hashWaitMax > 0 {
+		timeout := time.NewTimer(hashWaitMax)
+		select {
+		case <-done:
+		case <-timeout.C:
+		case <-r.Context().Done():
+		}
+		timeout.Stop()
+	}
+
+	hashes := make([]batchHashResponse, len(identifiers))
+	for i, identifier := range identifiers {
+		hashes[i].Id = formatIdentifier(identifier)
+
+		switch status, entry := getHashStatus(identifier); status {
+		case HashStatusCompleted:
+			hashes[i].Salt, hashes[i].Hash = encodeHashedPassword(entry)
+		case HashStatusCancelled:
+			hashes[i].Status = "cancelled"
+		case HashStatusFailed:
+			hashes[i].Status = "failed"
+		case HashStatusPending:
+			hashes[i].Status = "pending"
+		default:
+			// i.e. the hash was computed and then deleted before the response was written
+			hashes[i].Status = "deleted"
+		}
+	}
+	if err := writeJSON(w, http.StatusOK, map[string][]batchHashResponse{"hashes": hashes}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "hashBatch(2) writeJSON: %v\n", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Decodes the {"hashes":[...]} response of a POST /hash/batch?wait=true, failing the test if it is not one.
+ */
+func batchHashes(t *testing.T, w *httptest.ResponseRecorder) []batchHashResponse {
+	t.Helper()
+
+	var response map[string][]batchHashResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("POST /hash/batch?wait=true: status %d, body %q", w.Code, w.Body.String())
+	}
+	return response["hashes"]
+}
+
+/*
+** POST /hash/batch?wait=true answers once all of the hashes are done, with the hash of each password (in order)
+**   in the one response. Without wait, it answers right away with the identifiers.
+ */
+func TestHashBatch(t *testing.T) {
+	setForTest(t, &hashDelay, 0)
+
+	passwords := []string{"angryMonkey", "happyMonkey", "sleepyMonkey"}
+	hashes := batchHashes(t, request(http.MethodPost, "/hash/batch?wait=true",
+		"password="+strings.Join(passwords, "&password=")))
+	if len(hashes) != len(passwords) {
+		t.Fatalf("%d hashes for %d passwords", len(hashes), len(passwords))
+	}
+	for i, hashed := range hashes {
+		if hashed.Status != "" || hashed.Salt == "" || hashed.Hash == "" {
+			t.Errorf("hash %d: %+v, want the salt and the hash", i, hashed)
+			continue
+		}
+		// each hash is the hash of the password in the same position
+		w := request(http.MethodPost, "/hash/verify", "id="+hashed.Id+"&password="+passwords[i])
+		if strings.TrimSpace(w.Body.String()) != `{"match":true}` {
+			t.Errorf("POST /hash/verify of hash %d with %s: body %q", i, passwords[i], w.Body.String())
+		}
+		if hashedResponse(t, request(http.MethodGet, "/hash/"+hashed.Id, "")).Hash != hashed.Hash {
+			t.Errorf("GET /hash/%s does not return the hash of the batch", hashed.Id)
+		}
+	}
+
+	w := request(http.MethodPost, "/hash/batch", "password=angryMonkey&password=happyMonkey")
+	var response map[string][]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response["ids"]) != 2 {
+		t.Fatalf("POST /hash/batch: status %d, body %q, want 2 ids", w.Code, w.Body.String())
+	}
+	for _, identifier := range response["ids"] {
+		hashedResponse(t, waitForHashed(t, identifier))
+	}
+}
+
+/*
+** The hashes of a batch are limited to -batch-concurrency at a time, so with a limit of 1 the hashDelay of each one
+**   is waited in turn.
+ */
+func TestHashBatchConcurrency(t *testing.T) {
+	setForTest(t, &hashDelay, 50*time.Millisecond)
+	setForTest(t, &batchConcurrency, 1)
+
+	start := time.Now()
+	hashes := batchHashes(t, request(http.MethodPost, "/hash/batch?wait=true",
+		"password=angryMonkey&password=happyMonkey&password=sleepyMonkey"))
+	if elapsed := time.Since(start); elapsed < 3*hashDelay {
+		t.Errorf("3 hashes with a -batch-concurrency of 1 took %v, want at least %v", elapsed, 3*hashDelay)
+	}
+	for i, hashed := range hashes {
+		if hashed.Hash == "" {
+			t.Errorf("hash %d: %+v, want the hash", i, hashed)
+		}
+	}
+}
+
+/*
+** A hash that is not done within the -hash-wait-max is reported as pending. The whole batch is rejected if any of
+**   the passwords is empty, or if there are too many of them.
+ */
+func TestHashBatchRejects(t *testing.T) {
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{"password=angryMonkey&password=", http.StatusPreconditionFailed},
+		{"algo=md4", http.StatusPreconditionFailed},
+		{"password=angryMonkey&algo=md4", http.StatusUnprocessableEntity},
+		{strings.Repeat("password=angryMonkey&", MaxBatchPasswords+1), http.StatusRequestEntityTooLarge},
+	} {
+		if w := request(http.MethodPost, "/hash/batch", test.body); w.Code != test.status {
+			t.Errorf("POST /hash/batch %.40q: status %d, want %d", test.body, w.Code, test.status)
+		}
+	}
+	if w := request(http.MethodPost, "/hash/batch?wait=maybe", "password=angryMonkey"); w.Code !=
+		http.StatusUnprocessableEntity {
+		t.Errorf("wait=maybe: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	setForTest(t, &hashWaitMax, 50*time.Millisecond)
+	setForTest(t, &hashDelay, time.Hour)
+	// the shutdown ends the hashDelay of the pending hashes, so that the cleanup does not wait on them
+	t.Cleanup(func() {
+		requestShutdown(ShutdownReasonClient)
+		pendingHashes.Wait()
+		resetShutdownState()
+	})
+
+	hashes := batchHashes(t, request(http.MethodPost, "/hash/batch?wait=true", "password=angryMonkey"))
+	if len(hashes) != 1 || hashes[0].Status != "pending" || hashes[0].Hash != "" {
+		t.Errorf("wait=true past the -hash-wait-max: %+v, want the hash pending", hashes)
+	}
+}
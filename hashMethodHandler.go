@@ -1,14 +1,29 @@
 package main
 
 import (
-	"crypto/sha512"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +36,27 @@ import (
 var mu sync.Mutex
 var count = 0
 
+/*
+** The identifiers are parsed back as 32 bit integers by GET /hash/<identifier>, so the count cannot be allowed to go
+**   past MaximumIdentifier. What happens once it gets there is selected by the -id-overflow flag:
+**   IdOverflowRefuse - new POST /hash requests are rejected with INSUFFICIENT_STORAGE_507
+**   IdOverflowWrap - the count starts over at 1. The hashed passwords for the reused identifiers are
+**     overwritten as the new hashes are computed.
+ */
+const MaximumIdentifier = math.MaxInt32
+const IdOverflowRefuse = "refuse"
+const IdOverflowWrap = "wrap"
+
+var idOverflowPolicy = IdOverflowRefuse
+
+/*
+** The identifiers are rendered with the idFormat printf-style template (set with the -id-format flag) when they
+**   are returned from POST /hash, and are parsed back with the same template for GET /hash/<identifier>. For
+**   example, "hash_%06d" returns "hash_000123". The template must contain a single integer verb.
+ */
+var idFormat = "%d"
+var identifierVerb = regexp.MustCompile(`%[-+ 0]*[0-9]*d`)
+
 /*
 ** The requiredFormFields array of String is used to validate form data that is passed into the "POST /hash"
 **   method. Currently, there is only one required form field, but to add more, simply update the
@@ -28,28 +64,286 @@ var count = 0
  */
 const RequiredFormFields = 1
 const PasswordFormField = "password"
+const IdentifierFormField = "id"
+
+/*
+** The following are the supported sub-methods for the POST /hash/<sub-method> request
+ */
+const HashVerifyMethod = "verify"
+const HashBatchMethod = "batch"
 
 var requiredFormFields [RequiredFormFields]string
 
 /*
-** Do not allow the client to pass provide a password that is greater than 128 characters long. If they do,
-**   the POST /hash request will be rejected with a PRECONDITION_FAILED_412 error.
+** Do not allow the client to pass provide a password that is longer than maxPasswordLength (set via the
+**   -max-password-len flag, 128 by default). If they do, the POST /hash request will be rejected with a
+**   PRECONDITION_FAILED_412 error. A maxPasswordLength of 0 allows any length, in which case the password is only
+**   bounded by the maxBodySize.
+ */
+var maxPasswordLength = 128
+
+/*
+** When readOnlyMode is set (via the -read-only flag, which enables FeatureReadOnly), all of the requests that would
+**   modify the hashed passwords are rejected with METHOD_NOT_ALLOWED_405 while the read requests (GET
+**   /hash/<identifier>, POST /hash/verify and GET /stats) continue to work. This is used for disaster recovery.
+ */
+var readOnlyMode = false
+
+/*
+** A request body sent with "Content-Encoding: gzip" is decompressed before the form data is parsed. To prevent a
+**   small compressed body from expanding into something that overruns the memory in the server (a zip bomb), the
+**   decompressed body is limited to maxBodySize bytes as well. If the limit is exceeded, the request is rejected
+**   with a REQUEST_ENTITY_TOO_LARGE_413 error. If FeatureGzip is disabled, the gzip compressed bodies are rejected
+**   with UNSUPPORTED_MEDIA_TYPE_415.
+ */
+
+/*
+** The maxBodySize (set via the -max-body flag) limits the number of bytes of the POST /hash body that are read,
+**   both as it is sent and (for a gzip compressed body) once it is decompressed. Without it, the form parsing
+**   buffers the whole body before the length of the password is checked. If the limit is exceeded, the request is
+**   rejected with a REQUEST_ENTITY_TOO_LARGE_413 error. The maxPasswordLength check still applies to the password
+**   itself.
+ */
+var maxBodySize int64 = 1024 * 1024
+
+/*
+** The maximum number of bytes of a "multipart/form-data" body that are kept in memory while it is parsed. Anything
+**   beyond this is written to temporary files on disk (which are removed once the form is parsed). This is set with
+**   the -max-multipart-memory flag.
+ */
+var maxMultipartMemory int64 = 1024 * 1024
+
+/*
+** The acceptedContentTypes are the media types that the POST /hash bodies can be sent with. They are set from the
+**   -accept-content-types flag, which is a comma separated list of the names in the contentTypeNames map. A body
+**   with any other Content-Type is rejected with UNSUPPORTED_MEDIA_TYPE_415. A request without a Content-Type
+**   (i.e. the password is in the query string) is not checked.
+ */
+var acceptContentTypes = "form,multipart,json"
+var acceptedContentTypes = map[string]bool{
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+	"application/json":                  true,
+}
+
+var contentTypeNames = map[string]string{
+	"form":      "application/x-www-form-urlencoded",
+	"multipart": "multipart/form-data",
+	"json":      "application/json",
+}
+
+/*
+** The hashJsonBody is what is decoded from an "application/json" POST /hash body. The fields are added to the form
+**   values of the request (along with the query string), so the rest of the handling is the same as for the form
+**   bodies.
+ */
+type hashJsonBody struct {
+	Password *string `json:"password"`
+	Algo     *string `json:"algo"`
+	Id       *string `json:"id"`
+}
+
+/*
+** Sets the acceptedContentTypes from the acceptContentTypes list. Returns an error for a name that is not supported.
+ */
+func parseAcceptContentTypes() error {
+	accepted := map[string]bool{}
+	for _, name := range strings.Split(acceptContentTypes, ",") {
+		mediaType, ok := contentTypeNames[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unsupported content type %q", strings.TrimSpace(name))
+		}
+		accepted[mediaType] = true
+	}
+
+	acceptedContentTypes = accepted
+	return nil
+}
+
+/*
+** The pendingHashes keeps track of the performHash() goroutines that have not completed so that main() can wait for
+**   them prior to exiting.
+** If the shutdown starts while performHash() is still waiting to compute the hash, what happens is selected by the
+**   -hash-on-shutdown flag:
+**   HashOnShutdownCompute - skip the rest of the wait and compute the hash immediately
+**   HashOnShutdownFail - do not compute the hash, the identifier will never have a hashed password
+ */
+var pendingHashes sync.WaitGroup
+
+const HashOnShutdownCompute = "compute"
+const HashOnShutdownFail = "fail"
+
+var hashOnShutdownPolicy = HashOnShutdownCompute
+
+/*
+** The hashDelay (set via the -hash-delay flag) is how long performHash() waits prior to computing the hash. A delay
+**   of 0 computes the hash immediately.
+ */
+var hashDelay = 5000 * time.Millisecond
+
+/*
+** The pendingHashStarts records when each identifier that is still waiting for its hash was handed out. It is used
+**   by GET /stats to report the age of the oldest pending hash so that stuck hashing can be detected. The entry is
+**   removed when performHash() completes (whether or not the hash was computed), or when the identifier is deleted
+**   with DELETE /hash/<identifier> while it is still pending (in which case performHash() does not save the hash).
+ */
+var pendingMutex sync.Mutex
+var pendingHashStarts = make(map[int64]time.Time)
+
+/*
+** A GET /hash/<identifier>?wait=true request for an identifier that is still pending blocks until the hash is no
+**   longer pending (or for at most the hashWaitMax, set via the -hash-wait-max flag). The pendingHashWaiters holds
+**   a channel for each pending identifier that has a request waiting on it, which is closed when the identifier is
+**   removed from the pendingHashStarts. The channels are only created when a request waits, and are protected by
+**   the pendingMutex.
+ */
+var pendingHashWaiters = make(map[int64]chan struct{})
+var hashWaitMax = 10 * time.Second
+
+const HashWaitQueryParam = "wait"
+
+/*
+** The following are the states that the hash for an identifier can be in. They determine the response to
+**   GET /hash/<identifier>:
+**   HashStatusUnknown - the identifier was never handed out (or the hash was deleted), NOT_FOUND_404
+**   HashStatusPending - the hash has not been computed yet, ACCEPTED_202
+**   HashStatusCompleted - the hash is returned, OK_200
+**   HashStatusCancelled - the identifier was deleted while the hash was pending, GONE_410
+**   HashStatusFailed - the hash was never computed (i.e. -hash-on-shutdown=fail), INTERNAL_SERVER_ERROR_500
+** The hashOutcomes records the identifiers that ended up cancelled or failed, along with when that happened. It is
+**   protected by the pendingMutex. The outcomes expire after the hashTTL, the same as the hashed passwords, and are
+**   removed by the hash janitor.
+ */
+type hashStatus int
+
+const (
+	HashStatusUnknown hashStatus = iota
+	HashStatusPending
+	HashStatusCompleted
+	HashStatusCancelled
+	HashStatusFailed
+)
+
+type hashOutcome struct {
+	status hashStatus
+	ended  time.Time
+}
+
+var hashOutcomes = make(map[int64]hashOutcome)
+
+/*
+** The size of the chunks used to write the password into the hash function.
+ */
+const HashChunkSize = 4096
+
+/*
+** The hash algorithm is selected per request with the optional "algo" form field of POST /hash. The hashAlgorithms
+**   map holds the supported algorithm names, and DefaultHashAlgorithm is used when the field is not present. The
+**   name of the algorithm is saved along with the hashed password and returned by
+**   GET /hash/<identifier>?format=json so that clients do not need to hard code it.
+ */
+const AlgoFormField = "algo"
+const DefaultHashAlgorithm = "sha512"
+
+var hashAlgorithms = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+/*
+** Each hash is computed over a random salt of SaltLength bytes (generated by performHash() with crypto/rand)
+**   followed by the password, so the same password does not produce the same hash twice. The salt is saved along
+**   with the hashed password so that the hash can be verified later.
+ */
+const SaltLength = 16
+
+/*
+** The hashedPasswordResponse is what is returned by GET /hash/<identifier>. Both the salt and the hash are base64
+**   encoded, and the salt is what lets the hash be verified later. A bcrypt hash is returned as its encoded string,
+**   which has the salt embedded in it, so the salt is empty.
  */
-const MaximumAcceptablePasswordLength = 128
+type hashedPasswordResponse struct {
+	Salt string `json:"salt"`
+	Hash string `json:"hash"`
+}
 
 /*
-** The following is used to keep track of when the hashed password is saved for a particular index. There is a
-**   map that has locking that is available, but for now just using a mutex to protect access to the
-**   map from the different handlers.
+** The hashMetadataResponse is what is returned by GET /hash/<identifier>?format=json. The HashLength is the length
+**   of the raw digest in bytes (not the length of the base64 encoded hash). The Salt is base64 encoded and is empty
+**   for the hashes that were saved (in the -state-file) before the hashes were salted and for the bcrypt hashes.
  */
+type hashMetadataResponse struct {
+	Id         string `json:"id"`
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Algorithm  string `json:"algo"`
+	HashLength int    `json:"hash_len"`
+}
+
+/*
+** The following is used to keep track of when the hashed password is saved for a particular index. The workload is
+**   read heavy (clients poll GET /hash/<identifier>), so the readers never take a lock: they load the current
+**   passwordSnapshot through the hashedPasswords atomic pointer. A snapshot is never modified once it has been
+**   published, so a reader can never see a partially updated map. The writers are serialized by the passwordMutex
+**   and each write publishes a new snapshot.
+** Copying the whole map for every write would make filling the map O(N^2), so a snapshot is made of two maps. The
+**   base holds most of the entries and the recent holds the entries saved (or removed) since the base was last
+**   rebuilt. A write only copies the recent map, and once the recent map holds more than maxRecentEntries() it is
+**   folded into a new base. Since the recent map is allowed to grow to the square root of the base, each write
+**   costs O(sqrt(N)) amortized, while a reader looks in at most two maps.
+**
+** The map holds the raw digest (64 bytes for SHA512) rather than the base64 encoded string (88 bytes) to reduce the
+**   memory used per entry. The digest is only base64 encoded when it is returned to the client. The name of the
+**   algorithm that computed the digest, the salt and the id of the pepper (see pepperId()) are kept with it.
+**
+** Each entry also records when it was stored so that it can be evicted once it is older than the hashTTL (set via
+**   the -hash-ttl flag, 0 keeps the entries forever). An expired entry is treated as not found right away, and the
+**   hash janitor goroutine removes the expired entries from the map every HashJanitorInterval (or every hashTTL if
+**   that is shorter) so the memory used stays bounded.
+ */
+type storedHash struct {
+	algorithm string
+	salt      []byte
+	digest    []byte
+	pepperId  string
+	stored    time.Time
+}
+
+/*
+** An entry in the recent map without an algorithm records that the identifier was removed, which hides the entry
+**   for it in the base.
+ */
+type passwordSnapshot struct {
+	base   map[int64]storedHash
+	recent map[int64]storedHash
+}
+
+const MinimumRecentEntries = 64
+
 var passwordMutex sync.Mutex
-var hashedPasswords = make(map[int64]string)
+var hashedPasswords atomic.Pointer[passwordSnapshot]
+
+func init() {
+	hashedPasswords.Store(&passwordSnapshot{base: make(map[int64]storedHash), recent: make(map[int64]storedHash)})
+}
+
+var hashTTL = time.Hour
+
+const HashJanitorInterval = time.Minute
 
 /*
 ** Setup the required form fields. This uses an array to make the addition of additional required form fields easy.
+**   If there is a -state-file, the saved hashed passwords are also loaded from it.
  */
 func initializeHash() {
 	requiredFormFields[0] = PasswordFormField
+
+	if stateFile != "" {
+		if err := loadStateFile(); err != nil {
+			log.Fatalf("initializeHash: unable to load -state-file %q (%v)", stateFile, err)
+		}
+	}
 }
 
 /*
@@ -58,14 +352,50 @@ func initializeHash() {
  */
 func hash(w http.ResponseWriter, r *http.Request) {
 
-	defer measurePostTime(time.Now().UnixNano())
-
 	/*
 	** Duplicate code, but rather than passing in a different parameter (and making the method handler maps way more
 	**   complicated) re-parse the URL and see if there is only the "hash" filed (known to be true if the code got here)
 	**   or if there is a endpoint identifier that follows the /hash/<new field>
 	 */
-	methodStrings := strings.Split(r.URL.RequestURI(), "/")
+	methodStrings := splitHashPath(r.URL.Path)
+
+	/*
+	** The POST /hash/verify request does not create a new hash, so it is not counted in the POST /hash statistics
+	 */
+	if len(methodStrings) == 3 && methodStrings[2] == HashVerifyMethod {
+		verifyHash(w, r)
+		return
+	}
+
+	/*
+	** METHOD_NOT_ALLOWED_405
+	**
+	** When the server is running in read-only mode (-read-only flag) no new hashes can be created.
+	 */
+	if features.Enabled(FeatureReadOnly) {
+		writeError(w, http.StatusMethodNotAllowed, "read-only mode")
+		return
+	}
+
+	/*
+	** The POST /hash/batch request hands out an identifier for each of its passwords
+	 */
+	if len(methodStrings) == 3 && methodStrings[2] == HashBatchMethod {
+		hashBatch(w, r)
+		return
+	}
+
+	/*
+	** Only the requests that are handed an identifier are included in the /stats values, so that the "total" and
+	**   the time used for the "average" always cover the same set of requests.
+	 */
+	start := time.Now().UnixNano()
+	identifierAssigned := false
+	defer func() {
+		if identifierAssigned {
+			measurePostTime(start)
+		}
+	}()
 
 	/* DEBUG
 	for i := range methodStrings {
@@ -77,8 +407,8 @@ func hash(w http.ResponseWriter, r *http.Request) {
 	/*
 	** Parse out the form fields and make sure that "password" is present
 	 */
-	if err := r.ParseForm(); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "hashWithQualifier() ParseForm: %v\n", err)
+	if !parseHashForm(w, r, false) {
+		return
 	}
 
 	/* DEBUG
@@ -90,19 +420,52 @@ func hash(w http.ResponseWriter, r *http.Request) {
 	if validateFormData(r) {
 		numOfStr := len(methodStrings)
 		if numOfStr == 2 {
-			mu.Lock()
-			count++
-			tmp := count
-			mu.Unlock()
-
-			// Return the <identifier> for this POST request
-			n, err := fmt.Fprintf(w, "%d\n", tmp)
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "hash(1) Fprintf: %d %v\n", n, err)
+			/*
+			** UNPROCESSABLE_ENTITY_422
+			**
+			** The algorithm is checked before the identifier is handed out, so an unknown algorithm does not use
+			**   up an identifier.
+			 */
+			algorithm := r.FormValue(AlgoFormField)
+			if algorithm == "" {
+				algorithm = hashScheme
+			}
+			if !isHashAlgorithmEnabled(algorithm) {
+				writeError(w, http.StatusUnprocessableEntity, "unsupported algo")
+				return
+			}
+
+			// PRECONDITION_FAILED_412 - bcrypt would silently ignore the end of a longer password
+			if algorithm == BcryptHashAlgorithm && !fitsBcryptInput(r.FormValue(PasswordFormField)) {
+				writeError(w, http.StatusPreconditionFailed, "password too long for bcrypt")
+				return
+			}
+
+			tmp, ok := nextIdentifier()
+			if !ok {
+				// INSUFFICIENT_STORAGE_507
+				writeError(w, http.StatusInsufficientStorage, "")
+				return
+			}
+			identifierAssigned = true
+
+			// Return the <identifier> for this POST request (as JSON when it is wrapped in the -success-template)
+			if successTemplate != nil {
+				response := map[string]string{"id": formatIdentifier(int64(tmp))}
+				if err := writeJSON(w, http.StatusOK, response); err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "hash(1) writeJSON: %v\n", err)
+				}
+			} else {
+				n, err := fmt.Fprintf(w, "%s\n", formatIdentifier(int64(tmp)))
+				if err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "hash(1) Fprintf: %d %v\n", n, err)
+				}
 			}
 
 			password := r.FormValue(PasswordFormField)
-			go performHash(int64(tmp), password)
+			pendingHashes.Add(1)
+			addPendingHash(int64(tmp), time.Now())
+			go performHash(int64(tmp), algorithm, password)
 		} else {
 			/*
 			** UNPROCESSABLE_ENTITY_422
@@ -110,10 +473,7 @@ func hash(w http.ResponseWriter, r *http.Request) {
 			** Since the number of qualifiers was not 0, return UNPROCESSABLE_ENTITY since the code should not
 			**   return anything unexpected method qualifiers.
 			 */
-			n, err := fmt.Fprintf(w, "{\"error\": 422}\n")
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "hash(2) Fprintf: %d %v\n", n, err)
-			}
+			writeError(w, http.StatusUnprocessableEntity, "")
 		}
 	} else {
 		/*
@@ -121,11 +481,97 @@ func hash(w http.ResponseWriter, r *http.Request) {
 		**
 		** If all of the required form fields are not present, return the PRECONDITION_FAILED error code
 		 */
-		n, err := fmt.Fprintf(w, "{\"error\": 412}\n")
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "hash(3) Fprintf: %d %v\n", n, err)
+		writeError(w, http.StatusPreconditionFailed, "")
+	}
+}
+
+/*
+** Returns the next identifier to hand out for a POST /hash request. If the count has reached MaximumIdentifier, the
+**   idOverflowPolicy decides if the count wraps back around or if false is returned to refuse the request.
+ */
+func nextIdentifier() (int, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if count >= MaximumIdentifier {
+		if idOverflowPolicy != IdOverflowWrap {
+			return 0, false
 		}
+		count = 0
 	}
+
+	count++
+	return count, true
+}
+
+/*
+** Returns the identifier rendered with the -id-format template.
+ */
+func formatIdentifier(identifier int64) string {
+	return fmt.Sprintf(idFormat, identifier)
+}
+
+/*
+** Parses an identifier that was rendered with the -id-format template back into the integer count. The text around
+**   the integer verb must match exactly and the value must format back into the same string (so, for example, with
+**   "hash_%06d" the string "hash_42" is rejected since the identifier handed out was "hash_000042").
+ */
+func parseIdentifier(str string) (int64, error) {
+	verb := identifierVerb.FindStringIndex(idFormat)
+	prefix := idFormat[:verb[0]]
+	suffix := idFormat[verb[1]:]
+
+	if !strings.HasPrefix(str, prefix) || !strings.HasSuffix(str, suffix) || len(str) < len(prefix)+len(suffix) {
+		return 0, fmt.Errorf("identifier %q does not match the format %q", str, idFormat)
+	}
+
+	identifier, err := strconv.ParseInt(strings.TrimSpace(str[len(prefix):len(str)-len(suffix)]), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	if formatIdentifier(identifier) != str {
+		return 0, fmt.Errorf("identifier %q does not match the format %q", str, idFormat)
+	}
+
+	return identifier, nil
+}
+
+/*
+** Checks that the -id-format template has a single integer verb, does not contain anything that would split it
+**   into multiple URL path segments and that the identifiers round-trip through formatIdentifier() and
+**   parseIdentifier().
+ */
+func validateIdentifierFormat() error {
+	verbs := identifierVerb.FindAllStringIndex(idFormat, -1)
+	if len(verbs) != 1 || strings.Count(idFormat, "%") != 1 {
+		return fmt.Errorf("must contain exactly one integer verb (i.e. %%d)")
+	}
+	if strings.ContainsAny(idFormat, "/?#") {
+		return fmt.Errorf("must not contain '/', '?' or '#'")
+	}
+
+	for _, identifier := range []int64{1, 42, 123456, MaximumIdentifier} {
+		parsed, err := parseIdentifier(formatIdentifier(identifier))
+		if err != nil || parsed != identifier {
+			return fmt.Errorf("identifier %d does not round-trip", identifier)
+		}
+	}
+
+	return nil
+}
+
+/*
+** Splits the URL path of a /hash request into the method strings. Any empty strings at the end (from trailing
+**   slashes) are trimmed, so that "/hash/5/" and "/hash/5//" are treated the same as "/hash/5".
+ */
+func splitHashPath(path string) []string {
+	methodStrings := strings.Split(path, "/")
+	for len(methodStrings) > 2 && methodStrings[len(methodStrings)-1] == "" {
+		methodStrings = methodStrings[:len(methodStrings)-1]
+	}
+
+	return methodStrings
 }
 
 /*
@@ -138,7 +584,7 @@ func hashWithQualifier(w http.ResponseWriter, r *http.Request) {
 	**   complicated) re-parse the URL and see if there is only the "hash" filed (known to be true if the code got here)
 	**   or if there is a endpoint identifier that follows the /hash/<new field>
 	 */
-	methodStrings := strings.Split(r.URL.RequestURI(), "/")
+	methodStrings := splitHashPath(r.URL.Path)
 	/* DEBUG
 	for i := range methodStrings {
 		fmt.Printf("hash() index %d - %s\n", i, methodStrings[i])
@@ -149,11 +595,11 @@ func hashWithQualifier(w http.ResponseWriter, r *http.Request) {
 	numOfStr := len(methodStrings)
 	if numOfStr == 3 {
 		/*
-		** Validate that the field is an integer
+		** Validate that the field is an identifier in the configured format
 		 */
-		i, err := strconv.ParseInt(methodStrings[2], 10, 32)
+		i, err := parseIdentifier(methodStrings[2])
 		if err == nil {
-			returnHashedPassword(w, i)
+			returnHashedPassword(w, r, i)
 		} else {
 			/*
 			** UNPROCESSABLE_ENTITY_422
@@ -161,10 +607,7 @@ func hashWithQualifier(w http.ResponseWriter, r *http.Request) {
 			** Since the value passed in was not an integer, return UNPROCESSABLE_ENTITY since the code should not
 			**   return anything for a garbage method qualifier.
 			 */
-			n, err := fmt.Fprintf(w, "{\"error\": 422}\n")
-			if err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "hashWithQualifier(1) Fprintf: %d %v\n", n, err)
-			}
+			writeError(w, http.StatusUnprocessableEntity, "")
 		}
 	} else {
 		/*
@@ -173,33 +616,68 @@ func hashWithQualifier(w http.ResponseWriter, r *http.Request) {
 		** Since the number of qualifiers was not 1, return UNPROCESSABLE_ENTITY since the code should not
 		**   return anything unexpected method qualifiers.
 		 */
-		n, err := fmt.Fprintf(w, "{\"error\": 422}\n")
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "hashWithQualifier(2) Fprintf: %d %v\n", n, err)
-		}
+		writeError(w, http.StatusUnprocessableEntity, "")
 	}
 }
 
 /*
-** This function is used to compute the hash or a specific password/count combination. It waits for
-**   5 seconds prior to computing the hash for the password.
+** This function is used to compute the hash for a specific password/count combination. It waits for hashDelay
+**   (5 seconds by default) prior to computing the hash for the password.
+** If the shutdown is started while this is waiting, the hashOnShutdownPolicy decides if the hash is computed
+**   immediately or if the identifier is left without a hashed password.
  */
-func performHash(identifier int64, password string) {
+func performHash(identifier int64, algorithm string, password string) {
+	defer pendingHashes.Done()
+	defer removePendingHash(identifier)
 
 	/*
-	** Wait five second prior to computing the hash
+	** Wait the hashDelay (five seconds by default) prior to computing the hash
 	 */
-	time.Sleep(5000 * time.Millisecond)
+	if hashDelay > 0 {
+		delay := time.NewTimer(hashDelay)
+		select {
+		case <-delay.C:
+		case <-shutdownStartedSignal():
+			delay.Stop()
+			if hashOnShutdownPolicy == HashOnShutdownFail {
+				log.Printf("performHash: identifier %d not hashed due to shutdown", identifier)
+				failPendingHash(identifier)
+				return
+			}
+		}
+	}
 
 	/*
-	** Now compute the hash
+	** bcrypt generates (and embeds) its own salt
 	 */
-	h := sha512.New()
-	h.Write([]byte(password))
-	base64ResultStr := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	pepper, currentPepperId := currentPepperWithId()
+	var salt, digest []byte
+	if algorithm == BcryptHashAlgorithm {
+		var err error
+		if digest, err = computeBcryptHash(password, pepper); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "performHash() computeBcryptHash: %v\n", err)
+			failPendingHash(identifier)
+			return
+		}
+	} else {
+		/*
+		** Generate the salt here rather than in hash() so that the response to the POST /hash is not held up by it
+		 */
+		salt = make([]byte, SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "performHash() rand.Read: %v\n", err)
+			failPendingHash(identifier)
+			return
+		}
+
+		/*
+		** Now compute the hash
+		 */
+		digest = computeHash(algorithm, salt, password, pepper)
+	}
 
 	/* DEBUG
-	n, err := fmt.Printf("%d base64: %s", identifier, base64ResultStr)
+	n, err := fmt.Printf("%d base64: %s", identifier, base64.StdEncoding.EncodeToString(digest))
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
 	}
@@ -208,33 +686,760 @@ func performHash(identifier int64, password string) {
 	/*
 	** Save the hashed password in the map so that it can be accessed via the GET /hash/<identifier>
 	 */
+	entry := storedHash{algorithm: algorithm, salt: salt, digest: digest, pepperId: currentPepperId}
+	if !savePendingHash(identifier, entry) {
+		log.Printf("performHash: identifier %d was deleted while the hash was pending", identifier)
+	}
+}
+
+/*
+** Adds and removes the identifiers from the pendingHashStarts.
+ */
+func addPendingHash(identifier int64, now time.Time) {
+	pendingMutex.Lock()
+	pendingHashStarts[identifier] = now
+	pendingMutex.Unlock()
+}
+
+func removePendingHash(identifier int64) {
+	pendingMutex.Lock()
+	deletePendingHash(identifier)
+	pendingMutex.Unlock()
+}
+
+/*
+** Removes the identifier from the pendingHashStarts and wakes up the requests waiting on it. This must be called
+**   with the pendingMutex held.
+ */
+func deletePendingHash(identifier int64) {
+	delete(pendingHashStarts, identifier)
+
+	if waiters, found := pendingHashWaiters[identifier]; found {
+		close(waiters)
+		delete(pendingHashWaiters, identifier)
+	}
+}
+
+/*
+** Waits until the hash for the identifier is no longer pending, the hashWaitMax has passed or the request is
+**   cancelled (i.e. the client went away), whichever is first. Returns the state of the hash at that point.
+ */
+func waitForHash(ctx context.Context, identifier int64) (hashStatus, storedHash) {
+	pendingMutex.Lock()
+	if _, pending := pendingHashStarts[identifier]; !pending {
+		pendingMutex.Unlock()
+		return getHashStatus(identifier)
+	}
+	waiters, found := pendingHashWaiters[identifier]
+	if !found {
+		waiters = make(chan struct{})
+		pendingHashWaiters[identifier] = waiters
+	}
+	pendingMutex.Unlock()
+
+	timeout := time.NewTimer(hashWaitMax)
+	defer timeout.Stop()
+
+	select {
+	case <-waiters:
+	case <-timeout.C:
+	case <-ctx.Done():
+	}
+
+	return getHashStatus(identifier)
+}
+
+/*
+** Saves the hashed password for an identifier that is still pending. The pendingMutex is held while the hashed
+**   password is saved so that a DELETE /hash/<identifier> either removes the pending entry first (and the hash is
+**   not saved) or runs after the hash has been saved (and removes it). Returns false if the identifier was no longer
+**   pending.
+ */
+func savePendingHash(identifier int64, entry storedHash) bool {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if _, pending := pendingHashStarts[identifier]; !pending {
+		return false
+	}
+	setHashedPassword(identifier, entry)
+	deletePendingHash(identifier)
+
+	return true
+}
+
+/*
+** Removes the identifier from the pendingHashStarts if it is there. Returns true if it was pending.
+ */
+func cancelPendingHash(identifier int64) bool {
+	return endPendingHash(identifier, HashStatusCancelled)
+}
+
+/*
+** Records that the hash for the identifier was never computed.
+ */
+func failPendingHash(identifier int64) {
+	endPendingHash(identifier, HashStatusFailed)
+}
+
+/*
+** Removes the identifier from the pendingHashStarts and records the outcome for it, if it was pending. Returns true
+**   if it was pending.
+ */
+func endPendingHash(identifier int64, outcome hashStatus) bool {
+	pendingMutex.Lock()
+	_, pending := pendingHashStarts[identifier]
+	if pending {
+		deletePendingHash(identifier)
+		hashOutcomes[identifier] = hashOutcome{status: outcome, ended: time.Now()}
+	}
+	pendingMutex.Unlock()
+
+	return pending
+}
+
+/*
+** Returns the state of the hash for the identifier, along with the stored hash if it has been computed. The
+**   pendingMutex is held while the hashed passwords are checked, so an identifier that is just being saved by
+**   savePendingHash() is seen as either pending or completed (never unknown).
+ */
+func getHashStatus(identifier int64) (hashStatus, storedHash) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	if _, pending := pendingHashStarts[identifier]; pending {
+		return HashStatusPending, storedHash{}
+	}
+	if entry, found := getHashedPassword(identifier); found {
+		return HashStatusCompleted, entry
+	}
+	if outcome, found := hashOutcomes[identifier]; found && !isOutcomeExpired(outcome, time.Now()) {
+		return outcome.status, storedHash{}
+	}
+
+	return HashStatusUnknown, storedHash{}
+}
+
+/*
+** Returns how long the oldest identifier that is still waiting for its hash has been pending, or 0 if there are no
+**   pending hashes.
+ */
+func oldestPendingAge(now time.Time) time.Duration {
+	var oldest time.Duration
+
+	pendingMutex.Lock()
+	for _, start := range pendingHashStarts {
+		if age := now.Sub(start); age > oldest {
+			oldest = age
+		}
+	}
+	pendingMutex.Unlock()
+
+	return oldest
+}
+
+/*
+** Returns the entry for the identifier in the snapshot, looking in the recent map before the base.
+ */
+func (snapshot *passwordSnapshot) lookup(identifier int64) (storedHash, bool) {
+	if entry, found := snapshot.recent[identifier]; found {
+		return entry, entry.algorithm != ""
+	}
+
+	entry, found := snapshot.base[identifier]
+	return entry, found
+}
+
+/*
+** Returns how many entries the recent map can hold before it is folded into a base of the size.
+ */
+func maxRecentEntries(baseEntries int) int {
+	return int(math.Max(MinimumRecentEntries, math.Sqrt(float64(baseEntries))))
+}
+
+/*
+** Publishes the snapshot with the entry saved for the identifier (or removed, if the entry has no algorithm). This
+**   must be called with the passwordMutex held.
+ */
+func publishPassword(identifier int64, entry storedHash) {
+	current := hashedPasswords.Load()
+
+	recent := make(map[int64]storedHash, len(current.recent)+1)
+	for k, v := range current.recent {
+		recent[k] = v
+	}
+	if _, inBase := current.base[identifier]; entry.algorithm == "" && !inBase {
+		// there is nothing in the base to hide
+		delete(recent, identifier)
+	} else {
+		recent[identifier] = entry
+	}
+
+	if len(recent) <= maxRecentEntries(len(current.base)) {
+		hashedPasswords.Store(&passwordSnapshot{base: current.base, recent: recent})
+		return
+	}
+
+	base := make(map[int64]storedHash, len(current.base)+len(recent))
+	for k, v := range current.base {
+		base[k] = v
+	}
+	for k, v := range recent {
+		if v.algorithm == "" {
+			delete(base, k)
+		} else {
+			base[k] = v
+		}
+	}
+	hashedPasswords.Store(&passwordSnapshot{base: base, recent: make(map[int64]storedHash)})
+}
+
+/*
+** Saves the hashed password for the identifier. The stored time of the entry is set to now.
+ */
+func setHashedPassword(identifier int64, entry storedHash) {
+	now := time.Now()
+	entry.stored = now
+
 	passwordMutex.Lock()
-	hashedPasswords[identifier] = base64ResultStr
-	passwordMutex.Unlock()
+	publishPassword(identifier, entry)
+	releaseAndAppendStateRecords(stateRecord{
+		Id:        identifier,
+		Algorithm: entry.algorithm,
+		Salt:      base64.StdEncoding.EncodeToString(entry.salt),
+		Hash:      base64.StdEncoding.EncodeToString(entry.digest),
+		Pepper:    entry.pepperId,
+		Stored:    now.Unix(),
+	})
 }
 
 /*
-** This is used to obtain the hashed password for a particular identifier. If the password has not been hashed
-**   the method will respond with NOT_FOUND_404 otherwise it will respond with the hashed password
+** Removes the hashed password for the identifier. Returns false if there was no hashed password for the
+**   identifier.
  */
-func returnHashedPassword(w http.ResponseWriter, identifier int64) {
+func removeHashedPassword(identifier int64) bool {
+	passwordMutex.Lock()
+
+	if entry, found := hashedPasswords.Load().lookup(identifier); !found || isHashExpired(entry, time.Now()) {
+		passwordMutex.Unlock()
+		return false
+	}
+
+	publishPassword(identifier, storedHash{})
+	releaseAndAppendStateRecords(stateRecord{Id: identifier, Deleted: true})
 
+	return true
+}
+
+/*
+** Returns true if the entry is older than the hashTTL.
+ */
+func isHashExpired(entry storedHash, now time.Time) bool {
+	return hashTTL > 0 && now.Sub(entry.stored) > hashTTL
+}
+
+/*
+** Removes the expired entries from the map by publishing a snapshot with a new base that holds only the entries
+**   that have not expired. Returns the number of entries that were removed.
+ */
+func evictExpiredHashes(now time.Time) int {
 	passwordMutex.Lock()
-	password := hashedPasswords[identifier]
-	passwordMutex.Unlock()
 
-	if password == "" {
+	current := hashedPasswords.Load()
+	base := make(map[int64]storedHash, len(current.base))
+	for identifier, entry := range current.base {
+		base[identifier] = entry
+	}
+	for identifier, entry := range current.recent {
+		if entry.algorithm == "" {
+			delete(base, identifier)
+		} else {
+			base[identifier] = entry
+		}
+	}
+
+	var records []stateRecord
+	for identifier, entry := range base {
+		if isHashExpired(entry, now) {
+			delete(base, identifier)
+			records = append(records, stateRecord{Id: identifier, Deleted: true})
+		}
+	}
+	if len(records) > 0 {
+		hashedPasswords.Store(&passwordSnapshot{base: base, recent: make(map[int64]storedHash)})
+	}
+	releaseAndAppendStateRecords(records...)
+
+	return len(records)
+}
+
+/*
+** Returns true if the outcome is older than the hashTTL.
+ */
+func isOutcomeExpired(outcome hashOutcome, now time.Time) bool {
+	return hashTTL > 0 && now.Sub(outcome.ended) > hashTTL
+}
+
+/*
+** Removes the expired outcomes of the cancelled and failed hashes. Returns the number of outcomes that were removed.
+ */
+func evictExpiredOutcomes(now time.Time) int {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	evicted := 0
+	for identifier, outcome := range hashOutcomes {
+		if isOutcomeExpired(outcome, now) {
+			delete(hashOutcomes, identifier)
+			evicted++
+		}
+	}
+
+	return evicted
+}
+
+/*
+** This starts the hash janitor goroutine that evicts the expired entries (and the expired outcomes). It is started by
+**   startHttpServer() each time the server starts and stops once the shutdown of that server starts, so it must be
+**   called after resetShutdownState(). The hashJanitors is used to wait for it to stop. It does nothing if the
+**   hashTTL is 0.
+ */
+var hashJanitors sync.WaitGroup
+
+func startHashJanitor() {
+	if hashTTL <= 0 {
+		return
+	}
+
+	interval := HashJanitorInterval
+	if hashTTL < interval {
+		interval = hashTTL
+	}
+	shutdownSignal := shutdownStartedSignal()
+
+	hashJanitors.Add(1)
+	go func() {
+		defer hashJanitors.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if evicted := evictExpiredHashes(now); evicted > 0 {
+					log.Printf("hashJanitor: evicted %d expired hashed passwords", evicted)
+				}
+				evictExpiredOutcomes(now)
+			case <-shutdownSignal:
+				return
+			}
+		}
+	}()
+}
+
+/*
+** Computes the hash of the salt followed by the password (and then the pepper, if there is one) with the named
+**   algorithm and returns the raw digest. The algorithm must be one of the hashAlgorithms.
+**
+** The password is written into the hash through an io.Reader in chunks of at most HashChunkSize bytes rather
+**   than converting the whole password into a single []byte. This bounds the transient memory used while
+**   hashing if the maximum password length is raised significantly.
+ */
+func computeHash(algorithm string, salt []byte, password string, pepper []byte) []byte {
+	h := hashAlgorithms[algorithm].New()
+
+	h.Write(salt)
+
+	if err := writeInChunks(h, strings.NewReader(password)); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "computeHash() writeInChunks: %v\n", err)
+	}
+	h.Write(pepper)
+
+	return h.Sum(nil)
+}
+
+/*
+** Copies everything from the reader into the writer using a single buffer of HashChunkSize bytes. This does not
+**   use io.Copy() since that will hand off the copy to the reader's WriteTo() (if it has one), which writes the
+**   entire contents in a single call.
+ */
+func writeInChunks(w io.Writer, r io.Reader) error {
+	chunk := make([]byte, HashChunkSize)
+
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if _, writeErr := w.Write(chunk[:n]); writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+** This is the handler for the "POST /hash/verify" request. The form data must contain the "id" of a previously
+**   hashed password and the "password" to compare against it. The password is hashed with the same algorithm and
+**   salt that were used for the stored hash and the response is {"match": true} or {"match": false}.
+** If the identifier does not have a hashed password (either it is invalid or the hash has not been computed yet),
+**   the response is NOT_FOUND_404.
+ */
+func verifyHash(w http.ResponseWriter, r *http.Request) {
+
+	if !parseHashForm(w, r, false) {
+		return
+	}
+
+	if !validateFormData(r) {
+		// PRECONDITION_FAILED_412
+		writeError(w, http.StatusPreconditionFailed, "")
+		return
+	}
+
+	identifier, err := parseIdentifier(r.FormValue(IdentifierFormField))
+	if err != nil {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "")
+		return
+	}
+
+	entry, found := getHashedPassword(identifier)
+	if !found {
+		// NOT_FOUND_404
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+
+	/*
+	** The password is checked with the pepper that the hash was computed with, which is not known any more if the
+	**   pepper was changed before the server was restarted (in which case it cannot match).
+	 */
+	password := r.FormValue(PasswordFormField)
+	match := false
+	if pepper, known := pepperForId(entry.pepperId); !known {
+		log.Printf("verifyHash: identifier %d was hashed with a pepper that is no longer known", identifier)
+	} else if entry.algorithm == BcryptHashAlgorithm {
+		match = matchesBcryptHash(entry.digest, password, pepper)
+	} else {
+		digest := computeHash(entry.algorithm, entry.salt, password, pepper)
+		match = subtle.ConstantTimeCompare(digest, entry.digest) == 1
+	}
+
+	if err := writeJSON(w, http.StatusOK, map[string]bool{"match": match}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "verifyHash(4) writeJSON: %v\n", err)
+	}
+}
+
+/*
+** Returns the hashed password (and the algorithm used) saved for the identifier. The found return value is what
+**   determines if there is an entry for the identifier, rather than checking for an empty string, so an entry that
+**   is removed while this is being looked up is reported consistently as not found. An expired entry is also
+**   reported as not found. This does not take any lock (see passwordSnapshot).
+ */
+func getHashedPassword(identifier int64) (entry storedHash, found bool) {
+	entry, found = hashedPasswords.Load().lookup(identifier)
+	if !found || isHashExpired(entry, time.Now()) {
+		return storedHash{}, false
+	}
+
+	return entry, true
+}
+
+/*
+** This is the hash function that is called from the DELETE /hash verb. It removes the hashed password for the
+**   identifier and responds with OK_200 if there was one or NOT_FOUND_404 if there was not. The identifier is
+**   parsed the same way as for GET /hash/<identifier>, so an invalid or missing identifier is
+**   UNPROCESSABLE_ENTITY_422.
+** An identifier whose hash is still pending can also be deleted, in which case the hash is never saved.
+ */
+func deleteHashedPassword(w http.ResponseWriter, r *http.Request) {
+	/*
+	** METHOD_NOT_ALLOWED_405
+	**
+	** When the server is running in read-only mode (-read-only flag) no hashes can be removed.
+	 */
+	if features.Enabled(FeatureReadOnly) {
+		writeError(w, http.StatusMethodNotAllowed, "read-only mode")
+		return
+	}
+
+	methodStrings := splitHashPath(r.URL.Path)
+	if len(methodStrings) != 3 {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "")
+		return
+	}
+
+	identifier, err := parseIdentifier(methodStrings[2])
+	if err != nil {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "")
+		return
+	}
+
+	wasPending := cancelPendingHash(identifier)
+	if !removeHashedPassword(identifier) && !wasPending {
 		// NOT_FOUND_404
-		n, err := fmt.Fprintf(w, "{\"error\": 404}\n")
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+
+	// OK_200
+	if err := writeJSON(w, http.StatusOK, map[string]string{"deleted": formatIdentifier(identifier)}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "deleteHashedPassword() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** This is used to obtain the hashed password for a particular identifier. If the password has been hashed, it will
+**   respond with the base64 encoded salt and hashed password as {"salt": "...", "hash": "..."}. Otherwise the
+**   response depends on the state of the hash (see the HashStatus... constants).
+** The "format" query parameter selects another form of the hashed password:
+**   format=json - a JSON object with the identifier, the salt, the hash, the algorithm and the length of the digest
+**   format=text - the base64 encoded hash on its own as text/plain (what this used to return)
+**   format=jwt - the hash wrapped in a signed JWT (this requires the -jwt-key flag, otherwise the response is
+**     UNPROCESSABLE_ENTITY_422)
+** If the request has the "wait=true" query parameter and the hash is still pending, the response is held until the
+**   hash is no longer pending (up to the hashWaitMax). If it is still pending after that, the response is
+**   ACCEPTED_202 as usual.
+ */
+func returnHashedPassword(w http.ResponseWriter, r *http.Request, identifier int64) {
+
+	format := r.URL.Query().Get(HashFormatQueryParam)
+	if format != "" && format != HashFormatJson && format != HashFormatText &&
+		(format != HashFormatJwt || !features.Enabled(FeatureJwt)) {
+		// UNPROCESSABLE_ENTITY_422
+		writeError(w, http.StatusUnprocessableEntity, "unsupported format")
+		return
+	}
+
+	wait := false
+	if value := r.URL.Query().Get(HashWaitQueryParam); value != "" {
+		var err error
+		if wait, err = strconv.ParseBool(value); err != nil {
+			// UNPROCESSABLE_ENTITY_422
+			writeError(w, http.StatusUnprocessableEntity, "invalid wait")
+			return
+		}
+	}
+
+	status, entry := getHashStatus(identifier)
+	if status == HashStatusPending && wait && hashWaitMax > 0 {
+		status, entry = waitForHash(r.Context(), identifier)
+	}
+	switch status {
+	case HashStatusCompleted:
+		// OK_200 - the hashed password is returned below
+	case HashStatusPending:
+		// ACCEPTED_202
+		response := map[string]string{"id": formatIdentifier(identifier), "status": "pending"}
+		if err := writeJSON(w, http.StatusAccepted, response); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(4) writeJSON: %v\n", err)
+		}
+		return
+	case HashStatusCancelled:
+		// GONE_410
+		writeError(w, http.StatusGone, "cancelled")
+		return
+	case HashStatusFailed:
+		// INTERNAL_SERVER_ERROR_500
+		writeError(w, http.StatusInternalServerError, "hash failed")
+		return
+	default:
+		// NOT_FOUND_404
+		writeError(w, http.StatusNotFound, "")
+		return
+	}
+
+	salt, response := encodeHashedPassword(entry)
+	if format == "" {
+		if err := writeJSON(w, http.StatusOK, hashedPasswordResponse{Salt: salt, Hash: response}); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(5) writeJSON: %v\n", err)
+		}
+		return
+	}
+	if format == HashFormatJson {
+		err := writeJSON(w, http.StatusOK, hashMetadataResponse{
+			Id:         formatIdentifier(identifier),
+			Salt:       salt,
+			Hash:       response,
+			Algorithm:  entry.algorithm,
+			HashLength: len(entry.digest),
+		})
 		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(1) Fprintf: %d %v\n", n, err)
+			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(3) writeJSON: %v\n", err)
 		}
+		return
+	}
+
+	/*
+	** The plain base64 hash (and the JWT) are not JSON, so they are returned with their own Content-Type rather than
+	**   being wrapped in a JSON object.
+	 */
+	if format == HashFormatJwt {
+		token, err := signHashJwt(formatIdentifier(identifier), response, time.Now())
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(1) signHashJwt: %v\n", err)
+			return
+		}
+		response = token
+		w.Header().Set("Content-Type", "application/jwt")
 	} else {
-		n, err := fmt.Fprintf(w, "%s\n", password)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	n, err := fmt.Fprintf(w, "%s\n", response)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(2) Fprintf: %d %v\n", n, err)
+	}
+}
+
+/*
+** Returns the base64 encoded salt and hash of the entry. The bcrypt digest is already an encoded string (with the
+**   salt embedded in it), so it is returned as is with an empty salt.
+ */
+func encodeHashedPassword(entry storedHash) (salt string, hash string) {
+	if entry.algorithm == BcryptHashAlgorithm {
+		return "", string(entry.digest)
+	}
+
+	return base64.StdEncoding.EncodeToString(entry.salt), base64.StdEncoding.EncodeToString(entry.digest)
+}
+
+/*
+** This parses the form data for the POST /hash requests. If the body is gzip compressed, it is decompressed first
+**   (bounded by maxBodySize). The "application/x-www-form-urlencoded", "multipart/form-data" and
+**   "application/json" bodies are supported.
+** This returns false if the request cannot be processed, in which case the error response has already been written:
+**   UNSUPPORTED_MEDIA_TYPE_415 - the Content-Type is not in the -accept-content-types list
+**   BAD_REQUEST_400 - the body claims to be gzip compressed but is not valid gzip data
+**   BAD_REQUEST_400 - the body is not a valid JSON object (for an "application/json" body)
+**   REQUEST_ENTITY_TOO_LARGE_413 - the body (or the decompressed body) exceeds the maximum size
+**   BAD_REQUEST_400 - the password form field is present more than once (unless multiplePasswords is set)
+** Any other error parsing the form is logged and the missing form fields are caught by validateFormData().
+ */
+func parseHashForm(w http.ResponseWriter, r *http.Request, multiplePasswords bool) bool {
+	clearReadDeadline := applyBodyReadDeadline(w, r)
+	defer clearReadDeadline()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Header.Get("Content-Type") != "" && !acceptedContentTypes[mediaType] {
+		// UNSUPPORTED_MEDIA_TYPE_415
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported content type")
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		if !features.Enabled(FeatureGzip) {
+			// UNSUPPORTED_MEDIA_TYPE_415
+			writeError(w, http.StatusUnsupportedMediaType, "gzip bodies are disabled")
+			return false
+		}
+
+		gz, err := gzip.NewReader(r.Body)
 		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "returnHashedPassword(2) Fprintf: %d %v\n", n, err)
+			// BAD_REQUEST_400
+			writeError(w, http.StatusBadRequest, "")
+			return false
+		}
+		defer gz.Close()
+
+		r.Body = http.MaxBytesReader(w, gz, maxBodySize)
+	}
+
+	var err error
+	if mediaType == "multipart/form-data" {
+		/*
+		** Parts larger than maxMultipartMemory are spilled to temporary files. Only the form values are used, so
+		**   the temporary files can be removed as soon as the form has been parsed.
+		 */
+		err = r.ParseMultipartForm(maxMultipartMemory)
+		if r.MultipartForm != nil {
+			if removeErr := r.MultipartForm.RemoveAll(); removeErr != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "parseHashForm() RemoveAll: %v\n", removeErr)
+			}
 		}
+	} else if mediaType == "application/json" {
+		err = parseHashJson(r)
+
+		var syntaxError *json.SyntaxError
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &syntaxError) || errors.As(err, &typeError) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF) {
+			// BAD_REQUEST_400
+			writeError(w, http.StatusBadRequest, "malformed JSON body")
+			return false
+		}
+	} else {
+		err = r.ParseForm()
 	}
+
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "parseHashForm() ParseForm: %v\n", err)
+
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			// REQUEST_ENTITY_TOO_LARGE_413
+			writeError(w, http.StatusRequestEntityTooLarge, "")
+			return false
+		}
+
+		if isBodyReadTimeout(err) {
+			// REQUEST_TIMEOUT_408 - the rest of the body is never going to be read, so the connection is closed
+			w.Header().Set("Connection", "close")
+			writeError(w, http.StatusRequestTimeout, "body read timeout")
+			return false
+		}
+	}
+
+	/*
+	** BAD_REQUEST_400
+	**
+	** Only a single password can be hashed per request. If the password field is present more than once (in the
+	**   body or the query string), the request is ambiguous since r.FormValue() would silently use the first one.
+	 */
+	if len(r.Form[PasswordFormField]) > 1 && !multiplePasswords {
+		writeError(w, http.StatusBadRequest, "multiple password fields")
+		return false
+	}
+
+	return true
+}
+
+/*
+** Decodes an "application/json" body into the form values of the request. The query string is parsed into the form
+**   values first (r.ParseForm() does not read a JSON body), and then each field that is present in the body is added
+**   to them, so r.FormValue() returns the same thing as for a form body.
+ */
+func parseHashJson(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	var body hashJsonBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	if body.Password != nil {
+		r.Form.Add(PasswordFormField, *body.Password)
+	}
+	if body.Algo != nil {
+		r.Form.Add(AlgoFormField, *body.Algo)
+	}
+	if body.Id != nil {
+		r.Form.Add(IdentifierFormField, *body.Id)
+	}
+
+	return nil
 }
 
 /*
@@ -258,7 +1463,7 @@ func validateFormData(r *http.Request) bool {
 		** Check to insure the length of the password field does not exceed a specified maximum to
 		**   insure that a client cannot overrun the memory in the server
 		 */
-		if len(r.FormValue(PasswordFormField)) > MaximumAcceptablePasswordLength {
+		if maxPasswordLength > 0 && len(r.FormValue(PasswordFormField)) > maxPasswordLength {
 			success = false;
 		}
 	}
@@ -274,13 +1479,45 @@ func validateFormData(r *http.Request) bool {
 **   improvements.
  */
 func measurePostTime(start int64) {
-	elapsed := (time.Now().UnixNano() - start) / int64(time.Microsecond)
+	elapsed := time.Now().UnixNano() - start
 
 	/* DEBUG
 	log.Printf("POST /hash took %d", elapsed)
 	 */
 
 	mu.Lock()
-	totalTime += elapsed
+	if postStats.total == 0 || elapsed < postStats.minTime {
+		postStats.minTime = elapsed
+	}
+	if elapsed > postStats.maxTime {
+		postStats.maxTime = elapsed
+	}
+	postStats.total++
+	postStats.totalTime += elapsed
+
+	postStats.recentTimes[postStats.nextRecent] = elapsed
+	postStats.nextRecent = (postStats.nextRecent + 1) % PostTimeSampleSize
+	if postStats.validRecents < PostTimeSampleSize {
+		postStats.validRecents++
+	}
 	mu.Unlock()
+
+	statsdHashLatency(time.Duration(elapsed))
+}
+
+/*
+** Returns the names of the supported hash algorithms in sorted order. bcrypt is only included when it is the
+**   -hash-scheme.
+ */
+func supportedHashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms)+1)
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	if isHashAlgorithmEnabled(BcryptHashAlgorithm) {
+		names = append(names, BcryptHashAlgorithm)
+	}
+	sort.Strings(names)
+
+	return names
 }
@@ -0,0 +1,976 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+** The identifiers used by the tests that fill the map directly, well past the ones handed out by POST /hash (but
+**   still valid identifiers for the requests).
+ */
+const testIdentifierBase int64 = MaximumIdentifier - 1<<20
+
+/*
+** Builds the entry for the identifier. The algorithm and the digest are both derived from the identifier, so a reader
+**   can tell if it was handed an entry that mixes two writes.
+ */
+func testStoredHash(identifier int64) storedHash {
+	algorithm := "sha256"
+	if identifier%2 == 0 {
+		algorithm = "sha512"
+	}
+	digest := make([]byte, 8)
+	binary.BigEndian.PutUint64(digest, uint64(identifier))
+
+	return storedHash{algorithm: algorithm, salt: digest, digest: digest}
+}
+
+/*
+** Removes the identifiers from the map once the test is done.
+ */
+func removeTestHashes(tb testing.TB, count int) {
+	tb.Cleanup(func() {
+		for i := int64(0); i < int64(count); i++ {
+			removeHashedPassword(testIdentifierBase + i)
+		}
+	})
+}
+
+/*
+** The readers run while the writers add and remove the entries. Every entry a reader finds must be the complete
+**   entry for the identifier (run with -race to also catch the unsynchronized access).
+ */
+func TestHashedPasswordsConcurrentReadsAndWrites(t *testing.T) {
+	// enough identifiers that the recent map is folded into the base while the readers run
+	const identifiers = 4 * MinimumRecentEntries
+	const rounds = 40
+	removeTestHashes(t, identifiers)
+
+	var writers sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for round := 0; round < rounds; round++ {
+				for i := int64(0); i < identifiers; i++ {
+					setHashedPassword(testIdentifierBase+i, testStoredHash(testIdentifierBase+i))
+					if round%3 == 0 {
+						removeHashedPassword(testIdentifierBase + i)
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := int64(0); i < identifiers; i++ {
+					entry, found := getHashedPassword(testIdentifierBase + i)
+					if !found {
+						continue
+					}
+					want := testStoredHash(testIdentifierBase + i)
+					if entry.algorithm != want.algorithm || !bytes.Equal(entry.digest, want.digest) {
+						t.Errorf("identifier %d: torn read (algorithm %q, digest %x)", testIdentifierBase+i,
+							entry.algorithm, entry.digest)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+}
+
+/*
+** The entries that are saved and removed are found (or not) the same way before and after the recent map is folded
+**   into the base, and the recent map never grows past maxRecentEntries().
+ */
+func TestPasswordSnapshotFolds(t *testing.T) {
+	const identifiers = 1000
+	removeTestHashes(t, identifiers)
+
+	for i := int64(0); i < identifiers; i++ {
+		setHashedPassword(testIdentifierBase+i, testStoredHash(testIdentifierBase+i))
+		if i%3 == 0 {
+			removeHashedPassword(testIdentifierBase + i)
+		}
+
+		snapshot := hashedPasswords.Load()
+		if len(snapshot.recent) > maxRecentEntries(len(snapshot.base)) {
+			t.Fatalf("after %d writes: %d recent entries, want at most %d", i+1, len(snapshot.recent),
+				maxRecentEntries(len(snapshot.base)))
+		}
+	}
+
+	for i := int64(0); i < identifiers; i++ {
+		entry, found := getHashedPassword(testIdentifierBase + i)
+		if removed := i%3 == 0; found == removed {
+			t.Errorf("identifier %d: found %t, want %t", testIdentifierBase+i, found, !removed)
+		} else if found && !bytes.Equal(entry.digest, testStoredHash(testIdentifierBase+i).digest) {
+			t.Errorf("identifier %d: digest %x, want the one saved for it", testIdentifierBase+i, entry.digest)
+		}
+	}
+}
+
+/*
+** A write only copies the recent map, so its cost grows with the square root of the number of entries rather than
+**   with the number of entries (which is what copying the whole map on every write did). Compare the ns/op of the
+**   sub-benchmarks.
+ */
+func BenchmarkSetHashedPassword(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("%d_entries", size), func(b *testing.B) {
+			removeTestHashes(b, size+b.N)
+			for i := 0; i < size; i++ {
+				setHashedPassword(testIdentifierBase+int64(i), testStoredHash(testIdentifierBase+int64(i)))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				identifier := testIdentifierBase + int64(size+i)
+				setHashedPassword(identifier, testStoredHash(identifier))
+			}
+		})
+	}
+}
+
+/*
+** The rwMutexPasswords is a map guarded by a read/write lock (what the hashedPasswords used to be). It is the
+**   baseline that BenchmarkHashedPasswordsReadHeavy compares the snapshot against, so its set() and get() do the
+**   same work as setHashedPassword() and getHashedPassword() other than how the map is shared.
+ */
+type rwMutexPasswords struct {
+	mutex   sync.RWMutex
+	entries map[int64]storedHash
+}
+
+func (passwords *rwMutexPasswords) set(identifier int64, entry storedHash) {
+	now := time.Now()
+	entry.stored = now
+
+	passwords.mutex.Lock()
+	passwords.entries[identifier] = entry
+	appendStateRecord(stateRecord{
+		Id:        identifier,
+		Algorithm: entry.algorithm,
+		Salt:      base64.StdEncoding.EncodeToString(entry.salt),
+		Hash:      base64.StdEncoding.EncodeToString(entry.digest),
+		Stored:    now.Unix(),
+	})
+	passwords.mutex.Unlock()
+}
+
+func (passwords *rwMutexPasswords) get(identifier int64) (storedHash, bool) {
+	passwords.mutex.RLock()
+	entry, found := passwords.entries[identifier]
+	passwords.mutex.RUnlock()
+	if !found || isHashExpired(entry, time.Now()) {
+		return storedHash{}, false
+	}
+	return entry, true
+}
+
+/*
+** The lookups from GET /hash/<identifier> run in parallel with the occasional write (one for every readsPerWrite
+**   reads), against the snapshot and against the rwMutexPasswords. Compare the ns/op of the sub-benchmarks for each
+**   ratio (with -cpu to vary the number of readers). The snapshot trades more expensive writes for reads that
+**   never wait on a lock, so it only comes out ahead with enough readers and few enough writes.
+ */
+func BenchmarkHashedPasswordsReadHeavy(b *testing.B) {
+	const size = 10000
+
+	baseline := &rwMutexPasswords{entries: make(map[int64]storedHash)}
+	implementations := []struct {
+		name string
+		set  func(int64, storedHash)
+		get  func(int64) (storedHash, bool)
+	}{
+		{"snapshot", setHashedPassword, getHashedPassword},
+		{"rwmutex", baseline.set, baseline.get},
+	}
+
+	for _, readsPerWrite := range []int64{100, 10000} {
+		for _, implementation := range implementations {
+			b.Run(fmt.Sprintf("%s/reads_per_write_%d", implementation.name, readsPerWrite), func(b *testing.B) {
+				removeTestHashes(b, size)
+				for i := int64(0); i < size; i++ {
+					implementation.set(testIdentifierBase+i, testStoredHash(testIdentifierBase+i))
+				}
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := int64(0)
+					for pb.Next() {
+						identifier := testIdentifierBase + i%size
+						if i%readsPerWrite == 0 {
+							implementation.set(identifier, testStoredHash(identifier))
+						} else {
+							implementation.get(identifier)
+						}
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+/*
+** GET /hash/<identifier> reports each of the states of the hash: unknown (404), pending (202), completed (200),
+**   cancelled (410) and failed (500). The expired outcomes are removed by evictExpiredOutcomes().
+ */
+func TestHashStates(t *testing.T) {
+	if w := request(http.MethodGet, "/hash/999999999", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	completed := postHash(t, "password=angryMonkey")
+	if w := waitForHashed(t, completed); w.Code != http.StatusOK {
+		t.Errorf("completed: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	setForTest(t, &hashDelay, time.Hour)
+	setForTest(t, &hashOnShutdownPolicy, HashOnShutdownFail)
+
+	failed := postHash(t, "password=angryMonkey")
+	if w := request(http.MethodGet, "/hash/"+failed, ""); w.Code != http.StatusAccepted {
+		t.Errorf("pending: status %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	cancelled := postHash(t, "password=angryMonkey")
+	if w := request(http.MethodDelete, "/hash/"+cancelled, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE /hash/%s: status %d", cancelled, w.Code)
+	}
+	if w := request(http.MethodGet, "/hash/"+cancelled, ""); w.Code != http.StatusGone {
+		t.Errorf("cancelled: status %d, want %d", w.Code, http.StatusGone)
+	}
+
+	// the shutdown ends the hashDelay of the pending hash, which then fails (-hash-on-shutdown=fail)
+	requestShutdown(ShutdownReasonClient)
+	pendingHashes.Wait()
+	resetShutdownState()
+
+	if w := request(http.MethodGet, "/hash/"+failed, ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("failed: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	if evicted := evictExpiredOutcomes(time.Now().Add(2 * hashTTL)); evicted < 2 {
+		t.Errorf("evictExpiredOutcomes: evicted %d outcomes, want at least 2", evicted)
+	}
+	for _, identifier := range []string{failed, cancelled} {
+		if w := request(http.MethodGet, "/hash/"+identifier, ""); w.Code != http.StatusNotFound {
+			t.Errorf("expired outcome %s: status %d, want %d", identifier, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+/*
+** The hash janitor is started with each server start and stops with its shutdown, so a server that is started again
+**   after a shutdown still evicts the expired entries.
+ */
+func TestHashJanitorRestartsWithTheServer(t *testing.T) {
+	setForTest(t, &hashTTL, 20*time.Millisecond)
+
+	for start := 1; start <= 2; start++ {
+		identifier := testIdentifierBase + int64(start)
+		startHashJanitor()
+		setHashedPassword(identifier, testStoredHash(identifier))
+
+		evicted := false
+		for deadline := time.Now().Add(time.Second); !evicted && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+			_, found := hashedPasswords.Load().lookup(identifier)
+			evicted = !found
+		}
+		if !evicted {
+			t.Errorf("start %d: the expired entry was not evicted", start)
+		}
+
+		requestShutdown(ShutdownReasonClient)
+		hashJanitors.Wait()
+		resetShutdownState()
+	}
+}
+
+/*
+** A password of exactly -max-password-len is accepted, one byte more is rejected with PRECONDITION_FAILED_412, and a
+**   limit of 0 accepts any length.
+ */
+func TestMaxPasswordLength(t *testing.T) {
+	setForTest(t, &maxPasswordLength, 16)
+
+	if w := request(http.MethodPost, "/hash", "password="+strings.Repeat("a", 16)); w.Code != http.StatusOK {
+		t.Errorf("password at the limit: status %d, want %d", w.Code, http.StatusOK)
+	}
+	w := request(http.MethodPost, "/hash", "password="+strings.Repeat("a", 17))
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("password one over the limit: status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	maxPasswordLength = 0
+	if w := request(http.MethodPost, "/hash", "password="+strings.Repeat("a", 4096)); w.Code != http.StatusOK {
+		t.Errorf("long password with no limit: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** GET /hash/<identifier> that races DELETE /hash/<identifier> (run with -race) either returns the complete hash or
+**   NOT_FOUND_404, never an empty hash or any other status.
+ */
+func TestGetRacesDelete(t *testing.T) {
+	identifier := testIdentifierBase + 100
+	target := fmt.Sprintf("/hash/%d", identifier)
+	removeTestHashes(t, 101)
+
+	done := make(chan struct{})
+	var getters sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		getters.Add(1)
+		go func() {
+			defer getters.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := request(http.MethodGet, target, "")
+				switch {
+				case w.Code == http.StatusOK && strings.TrimSpace(w.Body.String()) == "":
+					t.Errorf("GET %s: OK_200 with an empty hash", target)
+					return
+				case w.Code != http.StatusOK && w.Code != http.StatusNotFound:
+					t.Errorf("GET %s: status %d, want %d or %d", target, w.Code, http.StatusOK, http.StatusNotFound)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		setHashedPassword(identifier, testStoredHash(identifier))
+		if w := request(http.MethodDelete, target, ""); w.Code != http.StatusOK {
+			t.Errorf("DELETE %s: status %d, want %d", target, w.Code, http.StatusOK)
+		}
+	}
+	close(done)
+	getters.Wait()
+
+	if w := request(http.MethodGet, target, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET %s after the DELETE: status %d, want %d", target, w.Code, http.StatusNotFound)
+	}
+}
+
+/*
+** With a custom -accept-content-types list, the POST /hash bodies with a listed type are accepted and the rest are
+**   rejected with UNSUPPORTED_MEDIA_TYPE_415. A name that is not supported is an error.
+ */
+func TestAcceptContentTypes(t *testing.T) {
+	setForTest(t, &acceptedContentTypes, acceptedContentTypes)
+	setForTest(t, &acceptContentTypes, "json")
+	if err := parseAcceptContentTypes(); err != nil {
+		t.Fatalf("parseAcceptContentTypes: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/hash", strings.NewReader(`{"password": "angryMonkey"}`))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("POST /hash with JSON: status %d, body %q, want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST /hash with a form: status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+
+	acceptContentTypes = "json,xml"
+	if err := parseAcceptContentTypes(); err == nil {
+		t.Errorf("parseAcceptContentTypes(%q): no error", acceptContentTypes)
+	}
+}
+
+/*
+** POST /hash/verify matches the password that was hashed (and not any other) for each of the algorithms, since it
+**   hashes the password with the algorithm and the salt of the stored hash.
+ */
+func TestVerifyHash(t *testing.T) {
+	for _, algorithm := range supportedHashAlgorithms() {
+		t.Run(algorithm, func(t *testing.T) {
+			identifier := postHash(t, "password=angryMonkey&algo="+algorithm)
+			if w := waitForHashed(t, identifier); w.Code != http.StatusOK {
+				t.Fatalf("GET /hash/%s: status %d", identifier, w.Code)
+			}
+
+			for password, match := range map[string]string{"angryMonkey": "true", "angryDonkey": "false"} {
+				w := request(http.MethodPost, "/hash/verify", "id="+identifier+"&password="+password)
+				want := `{"match":` + match + `}`
+				if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != want {
+					t.Errorf("verify %q: status %d, body %q, want %s", password, w.Code, w.Body.String(), want)
+				}
+			}
+		})
+	}
+
+	for body, want := range map[string]int{
+		"id=999999999&password=angryMonkey": http.StatusNotFound,
+		"id=abc&password=angryMonkey":       http.StatusUnprocessableEntity,
+		"id=1":                              http.StatusPreconditionFailed,
+	} {
+		if w := request(http.MethodPost, "/hash/verify", body); w.Code != want {
+			t.Errorf("verify %q: status %d, want %d", body, w.Code, want)
+		}
+	}
+}
+
+/*
+** Returns the gzip compressed body.
+ */
+func gzipBody(t *testing.T, body string) *bytes.Buffer {
+	t.Helper()
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write([]byte(body)); err != nil {
+		t.Fatalf("gzip Write: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip Close: %v", err)
+	}
+	return &compressed
+}
+
+/*
+** Sends the body to POST /hash as a gzip compressed form.
+ */
+func postGzipHash(body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/hash", body)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Content-Encoding", "gzip")
+	return serve(r)
+}
+
+/*
+** A gzip compressed body is decompressed before it is parsed (the hashed password is the decompressed one). A body
+**   that decompresses to more than the -max-body is rejected with REQUEST_ENTITY_TOO_LARGE_413, and
+**   one that is not gzip data with BAD_REQUEST_400.
+ */
+func TestGzipBody(t *testing.T) {
+	w := postGzipHash(gzipBody(t, "password=angryMonkey"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /hash with a gzip body: status %d, body %q", w.Code, w.Body.String())
+	}
+	identifier := strings.TrimSpace(w.Body.String())
+	waitForHashed(t, identifier)
+	w = request(http.MethodPost, "/hash/verify", "id="+identifier+"&password=angryMonkey")
+	if strings.TrimSpace(w.Body.String()) != `{"match":true}` {
+		t.Errorf("the gzip body was not decompressed: verify body %q", w.Body.String())
+	}
+
+	// a small body that decompresses to twice the limit
+	bomb := gzipBody(t, "password="+strings.Repeat("a", 2*int(maxBodySize)))
+	if bomb.Len() >= int(maxBodySize) {
+		t.Fatalf("the compressed body is %d bytes", bomb.Len())
+	}
+	if w := postGzipHash(bomb); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /hash with a decompression bomb: status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	if w := postGzipHash(strings.NewReader("password=angryMonkey")); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /hash with a body that is not gzip: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+/*
+** The decompressed body is held to the same -max-body as the body that is sent, so a lower -max-body also rejects a
+**   small gzip body that expands past it.
+ */
+func TestGzipBodyFollowsMaxBody(t *testing.T) {
+	setForTest(t, &maxBodySize, 1024)
+
+	if w := postGzipHash(gzipBody(t, "password=angryMonkey&pad="+strings.Repeat("a", 900))); w.Code != http.StatusOK {
+		t.Errorf("POST /hash with a gzip body within the -max-body: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	expands := gzipBody(t, "password=angryMonkey&pad="+strings.Repeat("a", 4096))
+	if expands.Len() >= 1024 {
+		t.Fatalf("the compressed body is %d bytes", expands.Len())
+	}
+	if w := postGzipHash(expands); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST /hash with a gzip body that expands past the -max-body: status %d, want %d", w.Code,
+			http.StatusRequestEntityTooLarge)
+	}
+}
+
+/*
+** In read-only mode, POST /hash and DELETE /hash/<identifier> get METHOD_NOT_ALLOWED_405 with the detail
+**   "read-only mode", while GET /hash/<identifier>, POST /hash/verify and GET /stats keep working.
+ */
+func TestReadOnlyMode(t *testing.T) {
+	identifier := postHash(t, "password=angryMonkey")
+	waitForHashed(t, identifier)
+	setFeatureForTest(t, FeatureReadOnly, true)
+
+	for _, w := range []*httptest.ResponseRecorder{
+		request(http.MethodPost, "/hash", "password=angryMonkey"),
+		request(http.MethodDelete, "/hash/"+identifier, ""),
+	} {
+		if w.Code != http.StatusMethodNotAllowed || !strings.Contains(w.Body.String(), `"detail":"read-only mode"`) {
+			t.Errorf("write in read-only mode: status %d, body %q", w.Code, w.Body.String())
+		}
+	}
+
+	if w := request(http.MethodGet, "/hash/"+identifier, ""); w.Code != http.StatusOK {
+		t.Errorf("GET /hash/%s in read-only mode: status %d, want %d", identifier, w.Code, http.StatusOK)
+	}
+	w := request(http.MethodPost, "/hash/verify", "id="+identifier+"&password=angryMonkey")
+	if w.Code != http.StatusOK {
+		t.Errorf("POST /hash/verify in read-only mode: status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /stats in read-only mode: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** A password that is written into the hash in several chunks gives the same digest as hashing it in a single write.
+ */
+func TestComputeHashInChunks(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	password := strings.Repeat("angryMonkey", 3*HashChunkSize/11+17)
+	if len(password) <= 3*HashChunkSize {
+		t.Fatalf("the password is only %d bytes", len(password))
+	}
+
+	for algorithm, hash := range hashAlgorithms {
+		reference := hash.New()
+		reference.Write(append(append([]byte{}, salt...), password...))
+		if digest := computeHash(algorithm, salt, password, nil); !bytes.Equal(digest, reference.Sum(nil)) {
+			t.Errorf("%s: the digest %x does not match the single write digest %x", algorithm, digest,
+				reference.Sum(nil))
+		}
+	}
+}
+
+/*
+** Sets the count so that the next identifier handed out is the one passed in. The count is put back once the test is
+**   done.
+ */
+func setNextIdentifierForTest(t *testing.T, next int) {
+	t.Helper()
+
+	mu.Lock()
+	original := count
+	count = next - 1
+	mu.Unlock()
+	t.Cleanup(func() {
+		pendingHashes.Wait()
+		mu.Lock()
+		count = original
+		mu.Unlock()
+	})
+}
+
+/*
+** Once the count reaches MaximumIdentifier, -id-overflow=refuse rejects the new hashes with INSUFFICIENT_STORAGE_507
+**   and -id-overflow=wrap starts the identifiers over at 1.
+ */
+func TestIdentifierOverflow(t *testing.T) {
+	setForTest(t, &idOverflowPolicy, IdOverflowRefuse)
+	setNextIdentifierForTest(t, MaximumIdentifier)
+
+	if identifier := postHash(t, "password=angryMonkey"); identifier != fmt.Sprint(MaximumIdentifier) {
+		t.Errorf("last identifier %s, want %d", identifier, MaximumIdentifier)
+	}
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("POST /hash past the maximum with refuse: status %d, want %d", w.Code, http.StatusInsufficientStorage)
+	}
+
+	idOverflowPolicy = IdOverflowWrap
+	if identifier := postHash(t, "password=angryMonkey"); identifier != "1" {
+		t.Errorf("POST /hash past the maximum with wrap: identifier %s, want 1", identifier)
+	}
+}
+
+/*
+** A multipart body with a part much larger than -max-multipart-memory is parsed (the large part is spilled to a
+**   temporary file) and the temporary files are removed once the form has been parsed.
+ */
+func TestLargeMultipartBody(t *testing.T) {
+	temporaryDirectory := t.TempDir()
+	t.Setenv("TMPDIR", temporaryDirectory)
+	setForTest(t, &maxMultipartMemory, 4096)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("password", "angryMonkey"); err != nil {
+		t.Fatalf("WriteField: %v", err)
+	}
+	part, err := form.CreateFormFile("attachment", "large.bin")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := part.Write(bytes.Repeat([]byte("x"), 512*1024)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/hash", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := serve(r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /hash with a large multipart body: status %d, body %q", w.Code, w.Body.String())
+	}
+	if w := waitForHashed(t, strings.TrimSpace(w.Body.String())); w.Code != http.StatusOK {
+		t.Errorf("GET /hash of the multipart password: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	leftover, err := os.ReadDir(temporaryDirectory)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(leftover) != 0 {
+		t.Errorf("%d temporary files were left behind by the multipart parse", len(leftover))
+	}
+}
+
+/*
+** A POST /hash with the password field more than once (in the body, or split between the query string and the body)
+**   is ambiguous and is rejected with BAD_REQUEST_400.
+ */
+func TestDuplicatePasswordFields(t *testing.T) {
+	setForTest(t, &hashDelay, 0)
+
+	for _, test := range []struct {
+		target string
+		body   string
+	}{
+		{"/hash", "password=angryMonkey&password=happyMonkey"},
+		{"/hash?password=happyMonkey", "password=angryMonkey"},
+	} {
+		w := request(http.MethodPost, test.target, test.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s %q: status %d, want %d", test.target, test.body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	postHash(t, "password=angryMonkey")
+}
+
+/*
+** A shutdown that starts during the hashDelay ends the wait. With -hash-on-shutdown=compute the hash is computed
+**   right away, and with -hash-on-shutdown=fail the identifier is left without a hashed password.
+ */
+func TestHashOnShutdown(t *testing.T) {
+	setForTest(t, &hashDelay, time.Hour)
+	setForTest(t, &hashOnShutdownPolicy, HashOnShutdownCompute)
+	t.Cleanup(func() { resetShutdownState() })
+
+	for _, test := range []struct {
+		policy string
+		status int
+	}{
+		{HashOnShutdownCompute, http.StatusOK},
+		{HashOnShutdownFail, http.StatusInternalServerError},
+	} {
+		hashOnShutdownPolicy = test.policy
+		identifier := postHash(t, "password=angryMonkey")
+
+		shutdownDone := make(chan struct{})
+		go func() {
+			requestShutdown(ShutdownReasonClient)
+			pendingHashes.Wait()
+			close(shutdownDone)
+		}()
+		if !closedSoon(shutdownDone) {
+			t.Fatalf("-hash-on-shutdown=%s: the pending hash did not end with the shutdown", test.policy)
+		}
+		resetShutdownState()
+
+		if w := request(http.MethodGet, "/hash/"+identifier, ""); w.Code != test.status {
+			t.Errorf("-hash-on-shutdown=%s: GET /hash/%s status %d, want %d", test.policy, identifier, w.Code,
+				test.status)
+		}
+	}
+}
+
+/*
+** With -id-format the identifiers handed out by POST /hash are rendered with the template and are accepted back by
+**   GET /hash/<identifier> only in the same form. The templates that do not round-trip are rejected.
+ */
+func TestIdentifierFormat(t *testing.T) {
+	setForTest(t, &idFormat, "hash_%06d")
+
+	identifier := postHash(t, "password=angryMonkey")
+	var count int64
+	if _, err := fmt.Sscanf(identifier, "hash_%06d", &count); err != nil || formatIdentifier(count) != identifier {
+		t.Fatalf("POST /hash: identifier %q, want hash_ and six digits", identifier)
+	}
+	if w := waitForHashed(t, identifier); w.Code != http.StatusOK {
+		t.Errorf("GET /hash/%s: status %d, want %d", identifier, w.Code, http.StatusOK)
+	}
+	if w := request(http.MethodGet, fmt.Sprintf("/hash/hash_%d", count), ""); w.Code == http.StatusOK {
+		t.Errorf("GET /hash/hash_%d (not padded): status %d, want an error", count, w.Code)
+	}
+	if w := request(http.MethodGet, fmt.Sprintf("/hash/%d", count), ""); w.Code == http.StatusOK {
+		t.Errorf("GET /hash/%d (no prefix): status %d, want an error", count, w.Code)
+	}
+
+	for _, format := range []string{"hash_%06d", "%d", "id-%d", "%08d.v1"} {
+		idFormat = format
+		if err := validateIdentifierFormat(); err != nil {
+			t.Errorf("-id-format %q: %v, want it accepted", format, err)
+		}
+	}
+	for _, format := range []string{"hash", "%d_%d", "%s", "%x", "hash/%d", "%d?", "100%%_%d"} {
+		idFormat = format
+		if err := validateIdentifierFormat(); err == nil {
+			t.Errorf("-id-format %q was accepted, want an error", format)
+		}
+	}
+}
+
+/*
+** Returns the salt and the hash from a GET /hash/<identifier> response, failing the test if it is not one.
+ */
+func hashedResponse(t *testing.T, w *httptest.ResponseRecorder) hashedPasswordResponse {
+	t.Helper()
+
+	var hashed hashedPasswordResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &hashed); err != nil || w.Code != http.StatusOK || hashed.Hash == "" {
+		t.Fatalf("GET /hash: status %d, body %q, want the salt and the hash", w.Code, w.Body.String())
+	}
+	return hashed
+}
+
+/*
+** GET /hash/<identifier> returns the salt along with the hash. The salt is different for each hash, so the same
+**   password hashed twice gives two different hashes. With format=text only the hash is returned, as text/plain.
+ */
+func TestHashIncludesSalt(t *testing.T) {
+	first := hashedResponse(t, waitForHashed(t, postHash(t, "password=angryMonkey")))
+	identifier := postHash(t, "password=angryMonkey")
+	second := hashedResponse(t, waitForHashed(t, identifier))
+
+	for _, hashed := range []hashedPasswordResponse{first, second} {
+		if salt, err := base64.StdEncoding.DecodeString(hashed.Salt); err != nil || len(salt) != SaltLength {
+			t.Errorf("salt %q, want %d base64 encoded bytes", hashed.Salt, SaltLength)
+		}
+	}
+	if first.Salt == second.Salt || first.Hash == second.Hash {
+		t.Errorf("the same password hashed twice: salts %q and %q, hashes %q and %q", first.Salt, second.Salt,
+			first.Hash, second.Hash)
+	}
+
+	w := request(http.MethodGet, "/hash/"+identifier+"?format=text", "")
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || strings.TrimSpace(w.Body.String()) != second.Hash {
+		t.Errorf("format=text: Content-Type %q and body %q, want text/plain and %q", w.Header().Get("Content-Type"),
+			w.Body.String(), second.Hash)
+	}
+}
+
+/*
+** The map keeps the raw digest (the size of the algorithm's output rather than the longer base64 string), and
+**   GET /hash/<identifier> returns it base64 encoded.
+ */
+func TestStoredDigestIsRaw(t *testing.T) {
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		identifier := postHash(t, "password=angryMonkey&algo="+algorithm)
+		w := waitForHashed(t, identifier)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /hash/%s: status %d, want %d", identifier, w.Code, http.StatusOK)
+		}
+
+		count, err := parseIdentifier(identifier)
+		if err != nil {
+			t.Fatalf("parseIdentifier(%q): %v", identifier, err)
+		}
+		entry, found := getHashedPassword(count)
+		if !found {
+			t.Fatalf("identifier %s is not in the map", identifier)
+		}
+		if len(entry.digest) != hashAlgorithms[algorithm].Size() {
+			t.Errorf("%s: %d bytes stored, want the %d byte digest", algorithm, len(entry.digest),
+				hashAlgorithms[algorithm].Size())
+		}
+
+		encoded := hashedResponse(t, w).Hash
+		if encoded != base64.StdEncoding.EncodeToString(entry.digest) || len(encoded) <= len(entry.digest) {
+			t.Errorf("%s: GET /hash/%s returned %q, want the base64 of the stored digest", algorithm, identifier,
+				encoded)
+		}
+	}
+}
+
+/*
+** GET /stats reports how long the oldest pending identifier has been waiting for its hash, and 0 once nothing is
+**   pending.
+ */
+func TestOldestPendingAge(t *testing.T) {
+	pendingHashes.Wait()
+	start := time.Now()
+	if age := oldestPendingAge(start); age != 0 {
+		t.Fatalf("oldestPendingAge with nothing pending: %v, want 0", age)
+	}
+
+	t.Cleanup(func() {
+		removePendingHash(testIdentifierBase)
+		removePendingHash(testIdentifierBase + 1)
+	})
+	addPendingHash(testIdentifierBase, start.Add(-time.Second))
+	addPendingHash(testIdentifierBase+1, start)
+
+	if age := oldestPendingAge(start.Add(3 * time.Second)); age != 4*time.Second {
+		t.Errorf("oldestPendingAge 3s later: %v, want 4s", age)
+	}
+	if age := getStats(t).OldestPendingAgeMs; age < 1000 || age > time.Since(start).Milliseconds()+1000 {
+		t.Errorf("GET /stats: oldest_pending_age_ms %d, want the age of the older entry", age)
+	}
+
+	removePendingHash(testIdentifierBase)
+	removePendingHash(testIdentifierBase + 1)
+	if age := getStats(t).OldestPendingAgeMs; age != 0 {
+		t.Errorf("GET /stats with nothing pending: oldest_pending_age_ms %d, want 0", age)
+	}
+}
+
+/*
+** GET /hash/<identifier>?format=json returns the algorithm that computed the hash and the length of the digest
+**   along with the hash, for the default algorithm as well as the one selected with the algo field.
+ */
+func TestHashMetadata(t *testing.T) {
+	for _, test := range []struct {
+		body      string
+		algorithm string
+	}{
+		{"password=angryMonkey", DefaultHashAlgorithm},
+		{"password=angryMonkey&algo=sha256", "sha256"},
+		{"password=angryMonkey&algo=sha384", "sha384"},
+	} {
+		identifier := postHash(t, test.body)
+		plain := waitForHashed(t, identifier)
+
+		w := request(http.MethodGet, "/hash/"+identifier+"?format=json", "")
+		var metadata hashMetadataResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: GET /hash/%s?format=json status %d, body %q", test.body, identifier, w.Code, w.Body.String())
+		}
+		if metadata.Algorithm != test.algorithm || metadata.HashLength != hashAlgorithms[test.algorithm].Size() {
+			t.Errorf("%q: algo %q and hash_len %d, want %q and %d", test.body, metadata.Algorithm,
+				metadata.HashLength, test.algorithm, hashAlgorithms[test.algorithm].Size())
+		}
+		hashed := hashedResponse(t, plain)
+		if metadata.Id != identifier || metadata.Hash != hashed.Hash || metadata.Salt != hashed.Salt {
+			t.Errorf("%q: id %q, salt %q and hash %q, want %q and the salt and hash of GET /hash", test.body,
+				metadata.Id, metadata.Salt, metadata.Hash, identifier)
+		}
+	}
+}
+
+/*
+** The trailing slashes are ignored, so /hash/<identifier>/ and /hash/<identifier>// get the same response as
+**   /hash/<identifier>, both for a hashed identifier and for an unknown one.
+ */
+func TestHashPathTrailingSlashes(t *testing.T) {
+	identifier := postHash(t, "password=angryMonkey")
+	waitForHashed(t, identifier)
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/hash/" + identifier, http.StatusOK},
+		{"/hash/999999999", http.StatusNotFound},
+	} {
+		want := request(http.MethodGet, test.path, "")
+		if want.Code != test.status {
+			t.Fatalf("GET %s: status %d, want %d", test.path, want.Code, test.status)
+		}
+
+		for _, path := range []string{test.path + "/", test.path + "//"} {
+			w := request(http.MethodGet, path, "")
+			if w.Code != want.Code || w.Body.String() != want.Body.String() {
+				t.Errorf("GET %s: status %d and body %q, want %d and %q (the same as %s)", path, w.Code,
+					w.Body.String(), want.Code, want.Body.String(), test.path)
+			}
+		}
+	}
+
+	for _, path := range []string{"/hash/5", "/hash/5/", "/hash/5//"} {
+		if methodStrings := splitHashPath(path); strings.Join(methodStrings, ",") != ",hash,5" {
+			t.Errorf("splitHashPath(%q) = %q, want [\"\" \"hash\" \"5\"]", path, methodStrings)
+		}
+	}
+}
+
+/*
+** GET /hash/<identifier>?wait=true holds the response until the hash is ready. If the hash is still pending after
+**   the -hash-wait-max, the response is the usual ACCEPTED_202.
+ */
+func TestWaitForHash(t *testing.T) {
+	setForTest(t, &hashWaitMax, 5*time.Second)
+	setForTest(t, &hashDelay, 100*time.Millisecond)
+
+	identifier := postHash(t, "password=angryMonkey")
+	start := time.Now()
+	w := request(http.MethodGet, "/hash/"+identifier+"?wait=true", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("wait=true: status %d, want %d once the hash is ready", w.Code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed >= hashWaitMax {
+		t.Errorf("wait=true: answered after %v, want it held until the hash was ready", elapsed)
+	}
+	hashedResponse(t, w)
+
+	if w := request(http.MethodGet, "/hash/"+identifier+"?wait=maybe", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wait=maybe: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	hashWaitMax = 50 * time.Millisecond
+	hashDelay = time.Hour
+	// the shutdown ends the hashDelay of the pending hash, so that the cleanup does not wait on it
+	t.Cleanup(func() {
+		requestShutdown(ShutdownReasonClient)
+		pendingHashes.Wait()
+		resetShutdownState()
+	})
+
+	identifier = postHash(t, "password=angryMonkey")
+	start = time.Now()
+	w = request(http.MethodGet, "/hash/"+identifier+"?wait=true", "")
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"status":"pending"`) {
+		t.Errorf("wait=true past the -hash-wait-max: status %d, body %q, want %d and pending", w.Code,
+			w.Body.String(), http.StatusAccepted)
+	}
+	if elapsed := time.Since(start); elapsed < hashWaitMax {
+		t.Errorf("wait=true: answered after %v, want it held for the -hash-wait-max", elapsed)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+/*
+** The pepper is a server-wide secret that is appended to every password prior to computing the hash. Unlike a salt,
+**   it is not stored with the hashes, so a copy of the hashes alone is not enough to run an offline attack. The
+**   pepper is read from the file set with the -pepper-file flag (a single trailing newline is ignored) and is
+**   re-read when the server receives a SIGHUP. If the file cannot be read on a SIGHUP, the current pepper is kept.
+**
+** Each hash records the id of the pepper it was computed with (a short SHA-256 fingerprint of the pepper, or
+**   NoPepperId), and every pepper loaded since the server started is kept by its id, so POST /hash/verify keeps
+**   matching the hashes computed before the pepper was changed. The peppers themselves are only kept in memory.
+**
+** NOTE: After a restart only the current pepper is known, so the hashes loaded from the -state-file that were
+**   computed with an older pepper no longer verify. The hashes without a pepper id (i.e. saved before the id was
+**   recorded) are verified with the current pepper.
+ */
+const NoPepperId = "none"
+
+type pepperState struct {
+	current []byte
+	id      string
+	known   map[string][]byte
+}
+
+var pepperFile = ""
+var peppers atomic.Pointer[pepperState]
+
+/*
+** Returns the id recorded with the hashes computed with the pepper.
+ */
+func pepperId(pepper []byte) string {
+	if len(pepper) == 0 {
+		return NoPepperId
+	}
+
+	fingerprint := sha256.Sum256(pepper)
+	return hex.EncodeToString(fingerprint[:8])
+}
+
+/*
+** Reads the pepper from the pepperFile and makes it the current pepper. The previous peppers are still known.
+ */
+func loadPepper() error {
+	contents, err := os.ReadFile(pepperFile)
+	if err != nil {
+		return err
+	}
+
+	contents = bytes.TrimSuffix(contents, []byte("\n"))
+	contents = bytes.TrimSuffix(contents, []byte("\r"))
+	if len(contents) == 0 {
+		return errors.New("pepper file is empty")
+	}
+
+	state := &pepperState{current: contents, id: pepperId(contents), known: make(map[string][]byte)}
+	if previous := peppers.Load(); previous != nil {
+		for id, known := range previous.known {
+			state.known[id] = known
+		}
+	}
+	state.known[state.id] = contents
+
+	peppers.Store(state)
+	return nil
+}
+
+/*
+** Returns the current pepper, or nil if there is no -pepper-file configured.
+ */
+func currentPepper() []byte {
+	pepper, _ := currentPepperWithId()
+	return pepper
+}
+
+/*
+** Returns the current pepper along with its id (both from the same load of the pepper file).
+ */
+func currentPepperWithId() ([]byte, string) {
+	if state := peppers.Load(); state != nil {
+		return state.current, state.id
+	}
+	return nil, NoPepperId
+}
+
+/*
+** Returns the pepper with the id, or false if it is not one of the peppers loaded since the server started. An
+**   empty id is the current pepper.
+ */
+func pepperForId(id string) ([]byte, bool) {
+	if id == "" {
+		return currentPepper(), true
+	}
+	if id == NoPepperId {
+		return nil, true
+	}
+
+	if state := peppers.Load(); state != nil {
+		if pepper, found := state.known[id]; found {
+			return pepper, true
+		}
+	}
+	return nil, false
+}
+
+/*
+** This starts a goroutine that re-reads the pepper file each time a SIGHUP is received. It does nothing if there is
+**   no -pepper-file configured.
+ */
+func handlePepperReloadSignal() {
+	if pepperFile == "" {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := loadPepper(); err != nil {
+				log.Printf("main: pepper not reloaded from %s: %v", pepperFile, err)
+			} else {
+				log.Printf("main: pepper reloaded from %s", pepperFile)
+			}
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+** Loads the contents as the -pepper-file for the test. The pepper is cleared again once the test is done.
+ */
+func loadPepperForTest(t *testing.T, contents string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pepper")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	original := peppers.Load()
+	setForTest(t, &pepperFile, path)
+	t.Cleanup(func() { peppers.Store(original) })
+
+	if err := loadPepper(); err != nil {
+		t.Fatalf("loadPepper: %v", err)
+	}
+}
+
+/*
+** The pepper (the contents of the file without the trailing newline) is appended to the password, so it changes the
+**   digest, and a different pepper gives a different digest again.
+ */
+func TestPepperChangesDigest(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	unpeppered := computeHash("sha512", salt, "angryMonkey", currentPepper())
+
+	loadPepperForTest(t, "secret\n")
+	peppered := computeHash("sha512", salt, "angryMonkey", currentPepper())
+	if bytes.Equal(peppered, unpeppered) {
+		t.Fatalf("the pepper did not change the digest")
+	}
+
+	want := sha512.Sum512([]byte("0123456789abcdefangryMonkeysecret"))
+	if !bytes.Equal(peppered, want[:]) {
+		t.Errorf("digest %x, want the digest of the salt, the password and the file contents %x", peppered, want)
+	}
+
+	// a new pepper (i.e. after a SIGHUP) is used from then on
+	if err := os.WriteFile(pepperFile, []byte("other"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := loadPepper(); err != nil {
+		t.Fatalf("loadPepper: %v", err)
+	}
+	if bytes.Equal(computeHash("sha512", salt, "angryMonkey", currentPepper()), peppered) {
+		t.Errorf("the reloaded pepper did not change the digest")
+	}
+}
+
+/*
+** An empty pepper file is rejected.
+ */
+func TestEmptyPepperFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pepper")
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	setForTest(t, &pepperFile, path)
+
+	if err := loadPepper(); err == nil {
+		t.Errorf("loadPepper of an empty file: no error")
+	}
+}
+
+/*
+** Each hash is verified with the pepper it was computed with, so the hashes computed before the pepper was rotated
+**   (i.e. by a SIGHUP) still verify, as do the ones computed after. A hash with the id of a pepper that is not known
+**   (i.e. from before a restart) cannot match.
+ */
+func TestPepperRotationVerifiesOldHash(t *testing.T) {
+	setForTest(t, &hashDelay, 0)
+	loadPepperForTest(t, "first")
+
+	verify := func(identifier string, password string) string {
+		w := request(http.MethodPost, "/hash/verify", "id="+identifier+"&password="+password)
+		return strings.TrimSpace(w.Body.String())
+	}
+
+	before := postHash(t, "password=angryMonkey")
+	waitForHashed(t, before)
+
+	if err := os.WriteFile(pepperFile, []byte("second"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := loadPepper(); err != nil {
+		t.Fatalf("loadPepper: %v", err)
+	}
+	after := postHash(t, "password=angryMonkey")
+	waitForHashed(t, after)
+
+	for _, identifier := range []string{before, after} {
+		if match := verify(identifier, "angryMonkey"); match != `{"match":true}` {
+			t.Errorf("POST /hash/verify of %s after the pepper was rotated: %s, want a match", identifier, match)
+		}
+		if match := verify(identifier, "happyMonkey"); match != `{"match":false}` {
+			t.Errorf("POST /hash/verify of %s with the wrong password: %s, want no match", identifier, match)
+		}
+	}
+
+	entry := testStoredHash(testIdentifierBase)
+	entry.digest = computeHash(entry.algorithm, entry.salt, "angryMonkey", []byte("forgotten"))
+	entry.pepperId = pepperId([]byte("forgotten"))
+	setHashedPassword(testIdentifierBase, entry)
+	removeTestHashes(t, 1)
+	if match := verify(fmt.Sprint(testIdentifierBase), "angryMonkey"); match != `{"match":false}` {
+		t.Errorf("POST /hash/verify with an unknown pepper: %s, want no match", match)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+/*
+** The jwtKey is the key used to sign the JWTs returned by GET /hash/<identifier>?format=jwt. It is set with the
+**   -jwt-key flag and, if it is empty, the JWT format is not available.
+ */
+var jwtKey = ""
+
+const HashFormatQueryParam = "format"
+const HashFormatJwt = "jwt"
+const HashFormatJson = "json"
+const HashFormatText = "text"
+
+/*
+** The hashClaims are the claims in the JWT that wraps a hashed password
+ */
+type hashClaims struct {
+	Id       string `json:"id"`
+	Hash     string `json:"hash"`
+	IssuedAt int64  `json:"iat"`
+}
+
+/*
+** Returns the hashed password for the identifier wrapped in a JWT signed with HS256 using the jwtKey. This lets
+**   downstream services verify that the hash has not been modified.
+ */
+func signHashJwt(identifier string, hash string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(hashClaims{Id: identifier, Hash: hash, IssuedAt: now.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, []byte(jwtKey))
+	mac.Write([]byte(signingInput))
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Checks the HS256 signature of the token with the key and returns its decoded claims.
+ */
+func verifyHashJwt(t *testing.T, token string, key string) hashClaims {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q does not have three parts", token)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Fatalf("token %q does not verify with the key", token)
+	}
+
+	var header map[string]string
+	decoded, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(decoded, &header); err != nil || header["alg"] != "HS256" || header["typ"] != "JWT" {
+		t.Errorf("token header %q, want HS256 and JWT", decoded)
+	}
+
+	var claims hashClaims
+	decoded, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(decoded, &claims); err != nil {
+		t.Fatalf("token claims %q: %v", decoded, err)
+	}
+	return claims
+}
+
+/*
+** GET /hash/<identifier>?format=jwt returns the hash in a JWT signed with the -jwt-key. The token verifies with the
+**   key and its claims hold the identifier, the hash and when it was issued. Without a -jwt-key the format is not
+**   supported.
+ */
+func TestHashJwt(t *testing.T) {
+	identifier := postHash(t, "password=angryMonkey")
+	plain := waitForHashed(t, identifier)
+	if plain.Code != http.StatusOK {
+		t.Fatalf("GET /hash/%s: status %d", identifier, plain.Code)
+	}
+
+	if w := request(http.MethodGet, "/hash/"+identifier+"?format=jwt", ""); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("format=jwt without a -jwt-key: status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	setForTest(t, &jwtKey, "jwt-test-key")
+	setFeatureForTest(t, FeatureJwt, true)
+
+	before := time.Now().Unix()
+	w := request(http.MethodGet, "/hash/"+identifier+"?format=jwt", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/jwt" {
+		t.Fatalf("format=jwt: status %d and Content-Type %q, want %d and application/jwt", w.Code,
+			w.Header().Get("Content-Type"), http.StatusOK)
+	}
+
+	claims := verifyHashJwt(t, strings.TrimSpace(w.Body.String()), "jwt-test-key")
+	if hash := hashedResponse(t, plain).Hash; claims.Id != identifier || claims.Hash != hash {
+		t.Errorf("claims id %q and hash %q, want %q and %q", claims.Id, claims.Hash, identifier, hash)
+	}
+	if claims.IssuedAt < before || claims.IssuedAt > time.Now().Unix() {
+		t.Errorf("claims iat %d, want the time of the request", claims.IssuedAt)
+	}
+}
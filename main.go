@@ -5,18 +5,242 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 /*
-** The following sync httpShutdownRequested is triggered when the /shutdown request is received and there are
-**   no outstanding requests being processed.
+** The following httpShutdownRequested channel is closed when the /shutdown request is received and there are
+**   no outstanding requests being processed. The httpShutdownOnce insures that it is only closed once, and both are
+**   recreated by resetShutdownState() so the server can be started again after a shutdown (i.e. when embedded).
+**   Both are protected by the requestsMutex.
+ */
+var httpShutdownRequested chan struct{}
+var httpShutdownOnce *sync.Once
+
+/*
+** The port the server listens on is taken from the -port flag, or the GO_SERVER_PORT environment variable if the flag
+**   is not set, or DefaultPort if neither is set. A port of 0 picks a free ephemeral port.
+ */
+const DefaultPort = "8080"
+const PortEnvironmentVariable = "GO_SERVER_PORT"
+
+/*
+** When both the tlsCertFile and tlsKeyFile are set (via the -tls-cert and -tls-key flags), the server only accepts
+**   HTTPS connections. When neither is set, the server uses plaintext HTTP.
+ */
+var tlsCertFile = ""
+var tlsKeyFile = ""
+
+/*
+** The shutdownTimeout bounds how long main() waits, once the shutdown has started, for the outstanding requests to
+**   drain and the HTTP server to shut down. If the timeout expires, the server exits with a non-zero code.
+ */
+var shutdownTimeout = 30 * time.Second
+
+/*
+** The values of these flags are secrets, so they are replaced with RedactedHeaderValue when the effective flags are
+**   logged at startup (an empty value is still logged as empty so it is clear the feature is off).
  */
-var httpShutdownRequested sync.WaitGroup
+var secretFlags = map[string]bool{
+	"hmac-secret": true,
+	"jwt-key":     true,
+}
 
 func main() {
+	defaultPort := DefaultPort
+	if envPort, ok := os.LookupEnv(PortEnvironmentVariable); ok {
+		defaultPort = envPort
+	}
+
+	var port string
+	flag.StringVar(&port, "port", defaultPort, "port to listen on, 0 picks a free port (default from "+
+		PortEnvironmentVariable+" or "+DefaultPort+")")
+	flag.BoolVar(&debugEndpointsEnabled, "debug", false, "enable the /debug endpoints")
+	flag.StringVar(&emptyMethodBehavior, "empty-method", EmptyMethodNotFound,
+		"response to a request with an empty method: notfound, index or redirect")
+	flag.StringVar(&emptyMethodRedirectLocation, "empty-method-redirect", "/stats",
+		"location used when -empty-method is redirect")
+	flag.IntVar(&maxStatsConcurrency, "max-stats-concurrency", 4, "maximum number of concurrent GET /stats requests")
+	flag.StringVar(&statsUnit, "stats-unit", StatsUnitMicroseconds, "unit of the GET /stats average: ns, us or ms")
+	flag.BoolVar(&readOnlyMode, "read-only", false, "reject requests that create new hashes")
+	flag.StringVar(&signatureSecret, "hmac-secret", "",
+		"shared secret used to verify the X-Signature header (disabled if empty)")
+	flag.DurationVar(&signatureMaxSkew, "hmac-max-skew", 5*time.Minute,
+		"maximum clock skew allowed for X-Signature-Timestamp")
+	flag.StringVar(&idOverflowPolicy, "id-overflow", IdOverflowRefuse,
+		"behavior once the identifiers reach the maximum: refuse or wrap")
+	flag.StringVar(&healthPath, "health-path", "/health", "path of the health check (in addition to /healthz and /livez)")
+	flag.StringVar(&errorFormat, "error-format", ErrorFormatNumeric, "format of the error responses: numeric or problem")
+	flag.Int64Var(&maxMultipartMemory, "max-multipart-memory", 1024*1024,
+		"bytes of a multipart/form-data body kept in memory (the rest spills to disk)")
+	flag.BoolVar(&nosniffHeaderEnabled, "header-nosniff", true, "send X-Content-Type-Options: nosniff")
+	flag.BoolVar(&frameDenyHeaderEnabled, "header-frame-deny", true, "send X-Frame-Options: DENY")
+	flag.IntVar(&hstsMaxAge, "hsts-max-age", 31536000,
+		"max-age of the Strict-Transport-Security header on TLS requests (0 disables)")
+	flag.StringVar(&hashOnShutdownPolicy, "hash-on-shutdown", HashOnShutdownCompute,
+		"what to do with hashes still waiting when the shutdown starts: compute or fail")
+	flag.StringVar(&idFormat, "id-format", "%d", "printf-style template used to render the identifiers (i.e. hash_%06d)")
+	flag.StringVar(&jwtKey, "jwt-key", "",
+		"key used to sign GET /hash/<identifier>?format=jwt responses (disabled if empty)")
+	flag.Int64Var(&maxBytesPerIPWindow, "max-bytes-per-ip-window", 0,
+		"maximum request body bytes a client IP can send per window before getting 429 (0 disables)")
+	flag.DurationVar(&bytesPerIPWindow, "bytes-per-ip-window", time.Minute,
+		"length of the -max-bytes-per-ip-window window")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "PEM certificate file to serve HTTPS with (requires -tls-key)")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "PEM private key file to serve HTTPS with (requires -tls-cert)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"how long to wait for the outstanding requests to drain once the shutdown starts")
+	flag.DurationVar(&bodyReadTimeout, "body-read-timeout", 0,
+		"longest a client may stall while sending a POST /hash body before getting 408 (0 disables)")
+	flag.DurationVar(&hashDelay, "hash-delay", 5000*time.Millisecond,
+		"how long to wait before computing each hash (0 disables)")
+	flag.StringVar(&pepperFile, "pepper-file", "",
+		"file holding a secret appended to every password before hashing (reloaded on SIGHUP)")
+	flag.StringVar(&successTemplateText, "success-template", "",
+		"text/template wrapping the JSON success responses, executed with .Status, .Payload and .Body")
+	flag.StringVar(&errorTemplateText, "error-template", "",
+		"text/template wrapping the JSON error responses, executed with .Status, .Payload and .Body")
+	flag.StringVar(&stateFile, "state-file", "",
+		"file the hashed passwords are saved to and loaded from at startup (disabled if empty)")
+	flag.DurationVar(&hashTTL, "hash-ttl", time.Hour,
+		"how long the hashed passwords are kept before they are evicted (0 keeps them forever)")
+	flag.BoolVar(&statsIncludeRuntime, "stats-include-runtime", false,
+		"include the goroutine and open file descriptor counts in GET /stats")
+	flag.StringVar(&acceptContentTypes, "accept-content-types", "form,multipart,json",
+		"comma separated content types accepted for the POST /hash bodies: form, multipart, json")
+	flag.StringVar(&statsdAddress, "statsd-addr", "",
+		"host:port of a StatsD daemon to send the metrics to over UDP (disabled if empty)")
+	flag.DurationVar(&hashWaitMax, "hash-wait-max", 10*time.Second,
+		"longest GET /hash/<identifier>?wait=true blocks waiting for a pending hash (0 never blocks)")
+	flag.Int64Var(&maxBodySize, "max-body", 1024*1024, "maximum bytes of a POST /hash body, larger bodies get 413")
+	flag.IntVar(&maxPasswordLength, "max-password-len", 128,
+		"maximum length of the POST /hash password, longer ones get 412 (0 is unlimited)")
+	flag.BoolVar(&autoHead, "auto-head", true, "answer HEAD requests with the headers of the GET handler for the method")
+	flag.StringVar(&requestLogLevel, "log-level", "info",
+		"level of the request log: debug, info, warn or error (requests are logged at info)")
+	flag.StringVar(&hashScheme, "hash-scheme", DefaultHashAlgorithm,
+		"algorithm of the POST /hash requests without an algo: sha512 or bcrypt (which also enables algo=bcrypt)")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", bcrypt.DefaultCost, "work factor of the bcrypt hashes (-hash-scheme=bcrypt)")
+	flag.IntVar(&bcryptCalibrateMs, "bcrypt-calibrate-ms", 0,
+		"pick the highest -bcrypt-cost that hashes within this many milliseconds at startup (0 disables)")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", runtime.NumCPU(),
+		"maximum number of the hashes of a POST /hash/batch computed at the same time")
+	flag.Parse()
+
+	if emptyMethodBehavior != EmptyMethodNotFound && emptyMethodBehavior != EmptyMethodIndex &&
+		emptyMethodBehavior != EmptyMethodRedirect {
+		log.Fatalf("main: invalid -empty-method %q (must be notfound, index or redirect)", emptyMethodBehavior)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		log.Fatalf("main: invalid port %q (must be a number from 1 to 65535, or 0 for a free port)", port)
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatalf("main: -tls-cert and -tls-key must be provided together (tls-cert=%q tls-key=%q)", tlsCertFile, tlsKeyFile)
+	}
+	if shutdownTimeout <= 0 {
+		log.Fatalf("main: invalid -shutdown-timeout %v (must be greater than 0)", shutdownTimeout)
+	}
+	if bodyReadTimeout < 0 {
+		log.Fatalf("main: invalid -body-read-timeout %v (must not be negative)", bodyReadTimeout)
+	}
+	if err := parseAcceptContentTypes(); err != nil {
+		log.Fatalf("main: invalid -accept-content-types %q (%v)", acceptContentTypes, err)
+	}
+	if hashTTL < 0 {
+		log.Fatalf("main: invalid -hash-ttl %v (must not be negative)", hashTTL)
+	}
+	if hashScheme != DefaultHashAlgorithm && hashScheme != BcryptHashAlgorithm {
+		log.Fatalf("main: invalid -hash-scheme %q (must be sha512 or bcrypt)", hashScheme)
+	}
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		log.Fatalf("main: invalid -bcrypt-cost %d (must be from %d to %d)", bcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if batchConcurrency < 1 {
+		log.Fatalf("main: invalid -batch-concurrency %d (must be at least 1)", batchConcurrency)
+	}
+	if bcryptCalibrateMs < 0 {
+		log.Fatalf("main: invalid -bcrypt-calibrate-ms %d (must not be negative)", bcryptCalibrateMs)
+	}
+	if maxPasswordLength < 0 {
+		log.Fatalf("main: invalid -max-password-len %d (must not be negative)", maxPasswordLength)
+	}
+	if maxBodySize <= 0 {
+		log.Fatalf("main: invalid -max-body %d (must be greater than 0)", maxBodySize)
+	}
+	if hashWaitMax < 0 {
+		log.Fatalf("main: invalid -hash-wait-max %v (must not be negative)", hashWaitMax)
+	}
+	if hashDelay < 0 {
+		log.Fatalf("main: invalid -hash-delay %v (must not be negative)", hashDelay)
+	}
+	if maxStatsConcurrency < 1 {
+		log.Fatalf("main: invalid -max-stats-concurrency %d (must be at least 1)", maxStatsConcurrency)
+	}
+	if _, ok := statsUnitDivisors[statsUnit]; !ok {
+		log.Fatalf("main: invalid -stats-unit %q (must be ns, us or ms)", statsUnit)
+	}
+	if idOverflowPolicy != IdOverflowRefuse && idOverflowPolicy != IdOverflowWrap {
+		log.Fatalf("main: invalid -id-overflow %q (must be refuse or wrap)", idOverflowPolicy)
+	}
+	if hashOnShutdownPolicy != HashOnShutdownCompute && hashOnShutdownPolicy != HashOnShutdownFail {
+		log.Fatalf("main: invalid -hash-on-shutdown %q (must be compute or fail)", hashOnShutdownPolicy)
+	}
+	if err := validateIdentifierFormat(); err != nil {
+		log.Fatalf("main: invalid -id-format %q (%v)", idFormat, err)
+	}
+	if errorFormat != ErrorFormatNumeric && errorFormat != ErrorFormatProblem {
+		log.Fatalf("main: invalid -error-format %q (must be numeric or problem)", errorFormat)
+	}
+	if !strings.HasPrefix(healthPath, "/") || len(healthPath) < 2 || strings.Contains(healthPath[1:], "/") {
+		log.Fatalf("main: invalid -health-path %q (must be a single path segment such as /health)", healthPath)
+	}
+	if healthPath == ReadinessPath {
+		log.Fatalf("main: invalid -health-path %q (it is used by the readiness check)", healthPath)
+	}
+
+	if err := initializeRequestLogger(); err != nil {
+		log.Fatalf("main: invalid -log-level %q (%v)", requestLogLevel, err)
+	}
+	if err := initializeStatsd(); err != nil {
+		log.Fatalf("main: invalid -statsd-addr %q (%v)", statsdAddress, err)
+	}
+	if err := initializeResponseTemplates(); err != nil {
+		log.Fatalf("main: invalid response template (%v)", err)
+	}
+	if pepperFile != "" {
+		if err := loadPepper(); err != nil {
+			log.Fatalf("main: invalid -pepper-file %q (%v)", pepperFile, err)
+		}
+	}
+
+	if hashScheme == BcryptHashAlgorithm && bcryptCalibrateMs > 0 {
+		bcryptCost = calibrateBcryptCost(time.Duration(bcryptCalibrateMs) * time.Millisecond)
+		log.Printf("main: -bcrypt-calibrate-ms %d picked a bcrypt cost of %d", bcryptCalibrateMs, bcryptCost)
+	}
+
+	// the methods are only known once the handlers are setup, so the -health-path is checked against them here
+	//   (startHttpServer() calls initialize() again, which does nothing the second time)
+	initialize()
+	if isMethodPath(healthPath) {
+		log.Fatalf("main: invalid -health-path %q (it is used by a method of the server)", healthPath)
+	}
+
+	logEffectiveFlags()
+
 	log.Printf("main: starting HTTP server")
 
 	// The httpServerExitDone WaitGroup is used to inform main() that the server has successfully exited and the
@@ -24,35 +248,129 @@ func main() {
 	httpServerExitDone := &sync.WaitGroup{}
 	httpServerExitDone.Add(1)
 
-	// The httpShutdownRequested is set when the curl request for "/shutdown" is made and the program can start
+	// The httpShutdownRequested is closed when the curl request for "/shutdown" is made and the program can start
 	//   waiting for the outstanding requests to drain. While the requests are draining, any new requests will
 	//   be responded to by the JSON object that returns {"error": 503}. 503 was chosen as it means:
 	//   SERVICE_UNAVAILABLE_503
-	httpShutdownRequested.Add(1)
+	shutdownSignal := resetShutdownState()
+
+	// SIGTERM and SIGINT trigger the same shutdown path as the /shutdown request. The handlers are installed prior
+	//   to starting the server so a signal that arrives while the server is starting is not lost.
+	handleShutdownSignals()
+
+	// SIGHUP re-reads the -pepper-file
+	handlePepperReloadSignal()
 
-	srv := startHttpServer(httpServerExitDone)
+	// startHttpServer() only returns once the listener is bound (or the bind failed and the shutdown was requested),
+	//   so a shutdown that is requested as soon as the server starts never runs srv.Shutdown() ahead of the
+	//   listener. If srv.Shutdown() runs before the goroutine calls Serve(), Serve() returns ErrServerClosed
+	//   right away.
+	srv := startHttpServer(":"+port, httpServerExitDone)
+
+	// once the shutdown starts, the outstanding requests have shutdownTimeout to drain
+	<-shutdownStartedSignal()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
 	// now close the server gracefully ("shutdown")
-	httpShutdownRequested.Wait()
-	if err := srv.Shutdown(context.TODO()); err != nil {
-		panic(err) // failure/timeout shutting down the server gracefully
+	select {
+	case <-shutdownSignal:
+	case <-ctx.Done():
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("main: shutdown timed out after %v with %d requests still outstanding (reason: %s)",
+			shutdownTimeout, getOutstandingRequests(), getShutdownReason())
 	}
 
 	// wait for goroutine started in startHttpServer() to stop
 	httpServerExitDone.Wait()
 
-	log.Printf("main: exiting")
+	// wait for any hashes that are still being computed (see the -hash-on-shutdown flag) and for the hash janitor
+	pendingHashes.Wait()
+	hashJanitors.Wait()
+
+	log.Printf("main: lifetime stats: %s", lifetimeSummary())
+
+	reason := getShutdownReason()
+	if reason == ShutdownReasonBindFailure {
+		log.Fatalf("main: exiting (reason: %s)", reason)
+	}
+	log.Printf("main: exiting (reason: %s)", reason)
+}
+
+/*
+** Logs the name and effective value of every flag (whether it was set on the command line or left at its default)
+**   on a single line, so the exact configuration of the server is captured in the log. The secret flags are
+**   redacted.
+ */
+func logEffectiveFlags() {
+	var settings []string
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = RedactedHeaderValue
+		}
+		settings = append(settings, fmt.Sprintf("-%s=%q", f.Name, value))
+	})
+
+	log.Printf("main: effective flags: %s", strings.Join(settings, " "))
 }
 
 /*
-** THis starts up the actual HTTP server which is listening on port 8080.
+** This clears the shutdown state and creates a new httpShutdownRequested channel so that the server can be started
+**   (again). It returns the channel that will be closed once the shutdown has been requested and the outstanding
+**   requests have drained.
+ */
+func resetShutdownState() <-chan struct{} {
+	requestsMutex.Lock()
+	shutdownRequested = false
+	shutdownReason = ""
+	shutdownStarted = make(chan struct{})
+	httpShutdownRequested = make(chan struct{})
+	httpShutdownOnce = &sync.Once{}
+	shutdownSignal := httpShutdownRequested
+	requestsMutex.Unlock()
+
+	return shutdownSignal
+}
+
+/*
+** Closes the httpShutdownRequested channel to let main() know it can shut down the HTTP server. This must be called
+**   with the requestsMutex held.
+ */
+func signalHttpShutdown() {
+	httpShutdownOnce.Do(func() { close(httpShutdownRequested) })
+}
+
+/*
+** This starts a goroutine that waits for either a SIGTERM or a SIGINT and then requests the shutdown with the
+**   reason set to the signal that was received.
+ */
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		if sig == syscall.SIGTERM {
+			requestShutdown(ShutdownReasonSigterm)
+		} else {
+			requestShutdown(ShutdownReasonSigint)
+		}
+	}()
+}
+
+/*
+** THis starts up the actual HTTP server which is listening on the passed in address (i.e. ":8080"). If the port in
+**   the address is 0, a free ephemeral port is picked and logged once the listener is bound. If the TLS certificate
+**   and key files are configured, the server is started with HTTPS instead of plaintext HTTP.
 **
 ** The server is setup with only a single handler function that all requests are routed through. This is done to
 **   simplify the handling of the shutdown process and to provide the ability to have different handlers
 **   that are used depending upon the state of the server. In this case, the states are simple, either running
 **   or in the process of being shut down.
  */
-func startHttpServer(wg *sync.WaitGroup) *http.Server {
+func startHttpServer(addr string, wg *sync.WaitGroup) *http.Server {
 
 	// Setup the initial HTTP Request handler map. This set of handlers covers the following methods:
 	//   POST /hash
@@ -60,21 +378,46 @@ func startHttpServer(wg *sync.WaitGroup) *http.Server {
 	//   PUT, POST, GET /shutdown
 	initialize()
 
-	// Start the HTTP Server running on port 8080
-	srv := &http.Server{Addr: ":8080"}
+	// The hash janitor runs until the shutdown of this server starts
+	startHashJanitor()
 
 	// All HTTP requests go through the common handler and then the URL is parsed to determine which
 	//   actual handler to use. This is done to allow the handlers to be changed on the fly once the
-	//   /shutdown method is processed.
-	http.HandleFunc("/", handler) // each request calls handler
+	//   /shutdown method is processed. Each server gets its own ServeMux (rather than the DefaultServeMux, which
+	//   panics if "/" is registered a second time) so the server can be started again after a shutdown.
+	mux := http.NewServeMux()
+	// each request calls handler (after the security headers are set and the signature is checked)
+	mux.HandleFunc("/", securityHeaders(requireSignature(handler)))
+
+	// Start the HTTP Server running on the configured port
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	// Bind the listener prior to starting the server goroutine so the actual port is known (for port 0)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		// unexpected error. port in use? Let main() shut down and report the reason.
+		log.Printf("Listen(): %v", err)
+		requestShutdown(ShutdownReasonBindFailure)
+		wg.Done()
+		return srv
+	}
+	useTls := features.Enabled(FeatureTLS)
+	log.Printf("main: listening on %s (tls: %t)", listener.Addr(), useTls)
 
 	go func() {
 		defer wg.Done() // let main know we are done cleaning up
 
 		// always returns error. ErrServerClosed on graceful close
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			// unexpected error. port in use?
-			log.Fatalf("ListenAndServe(): %v", err)
+		var err error
+		if useTls {
+			err = srv.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			// unexpected error. bad certificate or key? Let main() shut down and report the reason.
+			log.Printf("Serve(): %v", err)
+			requestShutdown(ShutdownReasonBindFailure)
 		}
 	}()
 
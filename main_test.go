@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+** When the RunMainEnvironmentVariable is set, the test binary runs main() instead of the tests. This is used by the
+**   tests that need the server as it is started from the command line (i.e. to capture the startup log).
+ */
+const RunMainEnvironmentVariable = "GO_SERVER_TEST_RUN_MAIN"
+
+/*
+** The handlers are set up once for all of the tests, the same way main() does it. The hashes are computed
+**   immediately (no hashDelay) unless a test sets its own delay, and the request log is turned off.
+ */
+func TestMain(m *testing.M) {
+	if os.Getenv(RunMainEnvironmentVariable) != "" {
+		main()
+		return
+	}
+
+	hashDelay = 0
+	requestLogLevel = "warn"
+	if err := initializeRequestLogger(); err != nil {
+		panic(err)
+	}
+	resetShutdownState()
+	initialize()
+
+	os.Exit(m.Run())
+}
+
+/*
+** Sends the request through the same chain of handlers that the HTTP server uses and returns the recorded response.
+ */
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	securityHeaders(requireSignature(handler))(w, r)
+	return w
+}
+
+/*
+** Builds a request with the verb and target. A non-empty body is sent as form data.
+ */
+func newRequest(verb string, target string, body string) *http.Request {
+	r := httptest.NewRequest(verb, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+/*
+** Shortcut for sending a request with the verb, target and form body.
+ */
+func request(verb string, target string, body string) *httptest.ResponseRecorder {
+	return serve(newRequest(verb, target, body))
+}
+
+/*
+** Sets the variable to the value for the duration of the test. The performHash() goroutines may read it, so the ones
+**   still running (i.e. left by an earlier test that did not wait for its hashes) are waited for before it is set,
+**   and the ones started by the test are waited for before the original value is restored.
+ */
+func setForTest[T any](t *testing.T, variable *T, value T) {
+	t.Helper()
+
+	pendingHashes.Wait()
+	original := *variable
+	*variable = value
+	t.Cleanup(func() {
+		pendingHashes.Wait()
+		*variable = original
+	})
+}
+
+/*
+** Starts the shutdown for the test and clears it again once the test is done, so that the following tests see a
+**   running server.
+ */
+func startShutdownForTest(t *testing.T) {
+	t.Helper()
+
+	requestShutdown(ShutdownReasonClient)
+	t.Cleanup(func() {
+		pendingHashes.Wait()
+		resetShutdownState()
+	})
+}
+
+/*
+** Hashes the password with POST /hash and returns the identifier, failing the test if the request fails.
+ */
+func postHash(t *testing.T, body string) string {
+	t.Helper()
+
+	w := request(http.MethodPost, "/hash", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /hash %q: status %d, body %q", body, w.Code, w.Body.String())
+	}
+	return strings.TrimSpace(w.Body.String())
+}
+
+/*
+** Waits (up to a second) for the hash of the identifier to be computed and returns the GET /hash/<identifier>
+**   response.
+ */
+func waitForHashed(t *testing.T, identifier string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		w := request(http.MethodGet, "/hash/"+identifier, "")
+		if w.Code != http.StatusAccepted || time.Now().After(deadline) {
+			return w
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+/*
+** initialize() can be called from multiple goroutines (run with -race), and the server can be started again once
+**   the previous one has shut down.
+ */
+func TestStartHttpServerAgain(t *testing.T) {
+	var initializers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		initializers.Add(1)
+		go func() {
+			defer initializers.Done()
+			initialize()
+		}()
+	}
+	initializers.Wait()
+
+	for start := 1; start <= 2; start++ {
+		done := &sync.WaitGroup{}
+		done.Add(1)
+		srv := startHttpServer("127.0.0.1:0", done)
+
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("start %d: GET /stats status %d, want %d", start, w.Code, http.StatusOK)
+		}
+
+		requestShutdown(ShutdownReasonClient)
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Errorf("start %d: Shutdown: %v", start, err)
+		}
+		done.Wait()
+		hashJanitors.Wait()
+		resetShutdownState()
+	}
+}
+
+/*
+** Returns true if the channel is closed within a second.
+ */
+func closedSoon(signal <-chan struct{}) bool {
+	select {
+	case <-signal:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+/*
+** The shutdown can be triggered, the state reset (as when an embedded server is started again) and the shutdown
+**   triggered again. Each start gets its own signal, which is only closed once the outstanding requests drain.
+ */
+func TestShutdownThenRestart(t *testing.T) {
+	t.Cleanup(func() { resetShutdownState() })
+
+	for start := 1; start <= 2; start++ {
+		shutdownSignal := resetShutdownState()
+		if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusOK {
+			t.Errorf("start %d: GET /stats status %d, want %d", start, w.Code, http.StatusOK)
+		}
+
+		// a request that is still in progress holds up the signal
+		incOutstandingAndCheckForShutdown()
+		if w := request(http.MethodPost, "/shutdown", ""); w.Code != http.StatusOK {
+			t.Errorf("start %d: POST /shutdown status %d, want %d", start, w.Code, http.StatusOK)
+		}
+		select {
+		case <-shutdownSignal:
+			t.Errorf("start %d: the shutdown was signaled with a request outstanding", start)
+		default:
+		}
+
+		decOutstandingAndCheckForShutdown()
+		if !closedSoon(shutdownSignal) {
+			t.Fatalf("start %d: the shutdown was not signaled once the requests drained", start)
+		}
+
+		// triggering it again does nothing (the signal is only closed once)
+		requestShutdown(ShutdownReasonClient)
+		if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("start %d: GET /stats during the shutdown status %d, want %d", start, w.Code,
+				http.StatusServiceUnavailable)
+		}
+	}
+}
+
+/*
+** A shutdown that is requested as soon as the server has started shuts it down without a hang or a panic.
+ */
+func TestShutdownImmediatelyAfterStart(t *testing.T) {
+	t.Cleanup(func() { resetShutdownState() })
+
+	for i := 0; i < 10; i++ {
+		shutdownSignal := resetShutdownState()
+		done := &sync.WaitGroup{}
+		done.Add(1)
+		srv := startHttpServer("127.0.0.1:0", done)
+
+		requestShutdown(ShutdownReasonClient)
+		if !closedSoon(shutdownSignal) {
+			t.Fatalf("the shutdown was not signaled")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+
+		served := make(chan struct{})
+		go func() {
+			done.Wait()
+			hashJanitors.Wait()
+			close(served)
+		}()
+		if !closedSoon(served) {
+			t.Fatalf("the server did not stop after the Shutdown")
+		}
+	}
+}
+
+/*
+** Runs main() in a copy of the test binary with the arguments and the environment variables (added to the ones of
+**   the test). Returns the scanner for its log, and the server is killed once the test is done.
+ */
+func startMainForTest(t *testing.T, environment []string, arguments ...string) *bufio.Scanner {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], arguments...)
+	cmd.Env = append(append(os.Environ(), RunMainEnvironmentVariable+"=1"), environment...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatalf("StderrPipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	return bufio.NewScanner(stderr)
+}
+
+/*
+** Reads the log of the server started by startMainForTest() up to the line with the address it is listening on and
+**   returns the port.
+ */
+func listeningPort(t *testing.T, scanner *bufio.Scanner) string {
+	t.Helper()
+
+	for scanner.Scan() {
+		if _, after, found := strings.Cut(scanner.Text(), "main: listening on "); found {
+			address, _, _ := strings.Cut(after, " ")
+			_, port, _ := net.SplitHostPort(address)
+			return port
+		}
+	}
+	t.Fatalf("no listening address in the startup log (%v)", scanner.Err())
+	return ""
+}
+
+/*
+** The effective value of every flag is logged at startup, with the secret flags redacted.
+ */
+func TestStartupLogsEffectiveFlags(t *testing.T) {
+	scanner := startMainForTest(t, nil, "-port", "0", "-max-password-len", "64", "-hmac-secret", "s3cret-hmac",
+		"-jwt-key", "s3cret-jwt")
+
+	var flagsLine string
+	for flagsLine == "" && scanner.Scan() {
+		if strings.Contains(scanner.Text(), "main: effective flags:") {
+			flagsLine = scanner.Text()
+		}
+	}
+	if flagsLine == "" {
+		t.Fatalf("no effective flags in the startup log (%v)", scanner.Err())
+	}
+
+	for _, want := range []string{`-max-password-len="64"`, `-port="0"`, `-hmac-secret="` + RedactedHeaderValue + `"`,
+		`-jwt-key="` + RedactedHeaderValue + `"`} {
+		if !strings.Contains(flagsLine, want) {
+			t.Errorf("startup log %q does not have %s", flagsLine, want)
+		}
+	}
+	if strings.Contains(flagsLine, "s3cret") {
+		t.Errorf("startup log %q has a secret", flagsLine)
+	}
+}
+
+/*
+** A SIGTERM starts the shutdown with the reason "signal:SIGTERM".
+ */
+func TestShutdownReasonSigterm(t *testing.T) {
+	t.Cleanup(func() {
+		signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+		resetShutdownState()
+	})
+
+	resetShutdownState()
+	handleShutdownSignals()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+
+	if !closedSoon(shutdownStartedSignal()) {
+		t.Fatalf("the SIGTERM did not start the shutdown")
+	}
+	if reason := getShutdownReason(); reason != ShutdownReasonSigterm {
+		t.Errorf("shutdown reason %q, want %q", reason, ShutdownReasonSigterm)
+	}
+}
+
+/*
+** A server that cannot bind its address starts the shutdown with the reason "bind-failure".
+ */
+func TestShutdownReasonBindFailure(t *testing.T) {
+	t.Cleanup(func() { resetShutdownState() })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	resetShutdownState()
+	done := &sync.WaitGroup{}
+	done.Add(1)
+	startHttpServer(listener.Addr().String(), done)
+	done.Wait()
+	hashJanitors.Wait()
+
+	if reason := getShutdownReason(); reason != ShutdownReasonBindFailure {
+		t.Errorf("shutdown reason %q, want %q", reason, ShutdownReasonBindFailure)
+	}
+}
+
+/*
+** Once the server has drained, a single line with the lifetime totals is logged before it exits.
+ */
+func TestShutdownLogsLifetimeStats(t *testing.T) {
+	scanner := startMainForTest(t, nil, "-port", "0", "-hash-delay", "0")
+	server := "http://127.0.0.1:" + listeningPort(t, scanner)
+
+	for _, test := range []struct {
+		verb   string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/hash", "password=angryMonkey", http.StatusOK},
+		{http.MethodPost, "/hash", "password=happyMonkey", http.StatusOK},
+		{http.MethodGet, "/stats", "", http.StatusOK},
+		{http.MethodGet, "/unknown", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/shutdown", "", http.StatusOK},
+	} {
+		r, _ := http.NewRequest(test.verb, server+test.path, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.verb, test.path, err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.verb, test.path, response.StatusCode, test.status)
+		}
+	}
+
+	var statsLine string
+	for statsLine == "" && scanner.Scan() {
+		if strings.Contains(scanner.Text(), "main: lifetime stats:") {
+			statsLine = scanner.Text()
+		}
+	}
+	if statsLine == "" {
+		t.Fatalf("no lifetime stats in the shutdown log (%v)", scanner.Err())
+	}
+	for _, want := range []string{"requests=5 ", "hashes=2 ", "errors=[405:1]", "uptime="} {
+		if !strings.Contains(statsLine, want) {
+			t.Errorf("lifetime stats %q do not have %s", statsLine, want)
+		}
+	}
+}
+
+/*
+** The port is taken from the -port flag, then the GO_SERVER_PORT environment variable. A port of 0 picks a free
+**   port, and a port that is not a number from 0 to 65535 stops the server at startup.
+ */
+func TestListenPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	_, freePort, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+
+	environment := []string{PortEnvironmentVariable + "=" + freePort}
+	if port := listeningPort(t, startMainForTest(t, environment)); port != freePort {
+		t.Errorf("%s=%s: listening on port %s", PortEnvironmentVariable, freePort, port)
+	}
+	if port := listeningPort(t, startMainForTest(t, environment, "-port", "0")); port == freePort || port == "0" {
+		t.Errorf("-port 0: listening on port %s, want a free port picked for it", port)
+	}
+
+	for _, test := range []struct {
+		environment []string
+		arguments   []string
+	}{
+		{nil, []string{"-port", "65536"}},
+		{nil, []string{"-port", "http"}},
+		{[]string{PortEnvironmentVariable + "=-1"}, nil},
+	} {
+		cmd := exec.Command(os.Args[0], test.arguments...)
+		cmd.Env = append(append(os.Environ(), RunMainEnvironmentVariable+"=1"), test.environment...)
+		output, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(output), "main: invalid port") {
+			t.Errorf("%v %v: exited with %v and logged %q, want an invalid port", test.environment, test.arguments,
+				err, output)
+		}
+	}
+}
+
+/*
+** A request that does not finish within the -shutdown-timeout stops the server with the number of requests still
+**   outstanding logged, rather than the shutdown waiting on it forever.
+ */
+func TestShutdownTimeout(t *testing.T) {
+	scanner := startMainForTest(t, nil, "-port", "0", "-shutdown-timeout", "200ms")
+	port := listeningPort(t, scanner)
+	server := "http://127.0.0.1:" + port
+
+	// a POST /hash that never sends the rest of its body stays outstanding
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = fmt.Fprintf(conn, "POST /hash HTTP/1.1\r\nHost: localhost\r\n"+
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: 100\r\n\r\npassword=")
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for inflight := int32(0); inflight < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the POST /hash was not outstanding")
+		}
+		response, err := http.Get(server + "/stats")
+		if err != nil {
+			t.Fatalf("GET /stats: %v", err)
+		}
+		var stats statsResponse
+		_ = json.NewDecoder(response.Body).Decode(&stats)
+		_ = response.Body.Close()
+		inflight = stats.Inflight
+	}
+
+	response, err := http.Post(server+"/shutdown", "", nil)
+	if err != nil {
+		t.Fatalf("POST /shutdown: %v", err)
+	}
+	_ = response.Body.Close()
+
+	var log []string
+	for scanner.Scan() {
+		log = append(log, scanner.Text())
+	}
+	output := strings.Join(log, "\n")
+	if !strings.Contains(output, "main: shutdown timed out after 200ms with 1 requests still outstanding") {
+		t.Errorf("the shutdown log %q does not have the timeout", output)
+	}
+	if strings.Contains(output, "main: exiting") || strings.Contains(output, "panic:") {
+		t.Errorf("the shutdown log %q has an exit without the timeout error", output)
+	}
+}
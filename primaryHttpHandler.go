@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 /*
@@ -23,61 +28,271 @@ var requestsMutex sync.Mutex
 var outstandingRequests int32 = 0
 var shutdownRequested = false
 
-// There are two separate maps to handle the different HTTP verbs that are supported.
+/*
+** The shutdownReason records what triggered the shutdown so that main() can log it prior to exiting. It is set at
+**   the same time as the shutdownRequested flag (under the requestsMutex) and is only set once, so the first trigger
+**   is the one that is reported.
+ */
+var shutdownReason = ""
+
+/*
+** The shutdownStarted channel is closed when the shutdown is requested. This allows goroutines that are waiting
+**   (i.e. performHash()) to select on it and react to the shutdown. It is created by resetShutdownState() and is
+**   protected by the requestsMutex (use shutdownStartedSignal() to access it).
+ */
+var shutdownStarted chan struct{}
+
+/*
+** The following are the possible values for the shutdownReason
+ */
+const ShutdownReasonClient = "client:/shutdown"
+const ShutdownReasonSigterm = "signal:SIGTERM"
+const ShutdownReasonSigint = "signal:SIGINT"
+const ShutdownReasonBindFailure = "bind-failure"
+
+// There are separate maps to handle the different HTTP verbs that are supported.
+//   DELETE /hash/<integer value>
 //   POST /hash
 //   POST /hash/<integer value>
+//   POST /drain?method=<method>
+//   POST /resume?method=<method>
 //   GET /stats
+//   GET /capabilities
+//   GET /debug/requests
+//   GET /debug/echo
+//   GET, POST /shutdown
 var postHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
 var getHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
+var putHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
+var patchHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
+var deleteHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
 
 // There is one map to figure out which verbs are supported and which method map to use
 var verbHttpMap = make(map[string]map[string]func(http.ResponseWriter, *http.Request))
 
+// The genericHandlerMap holds the handlers that are verb-agnostic. These are used when the verb specific map does
+//   not have an entry for the method. A verb that is not supported (has no map) never reaches them.
+//   <any supported verb> /health (the -health-path and the healthPathAliases)
+var genericHandlerMap = make(map[string]func(http.ResponseWriter, *http.Request))
+
 /*
 ** The following are the supported methods
  */
+const CapabilitiesMethod = "capabilities"
+const DebugMethod = "debug"
 const HashMethod = "hash"
 const ShutdownMethod = "shutdown"
 const StatsMethod = "stats"
 
+/*
+** The health check is registered under the path set by the -health-path flag as well as the common aliases that
+**   the different orchestrators expect.
+ */
+var healthPath = "/health"
+var healthPathAliases = []string{"/healthz", "/livez"}
+
+/*
+** The readiness check is served on the ReadinessPath. Unlike the health check, it reflects the shutdown state so that
+**   the load balancer stops sending new requests as soon as the shutdown starts.
+ */
+const ReadinessPath = "/readyz"
+
 /*
 ** The following are the supported HTTP verbs.
 **
-** NOTE: This current implementation does not support DELETE, PATCH and PUT
+** NOTE: There are no methods registered for PATCH and PUT yet, so those requests return METHOD_NOT_ALLOWED_405
  */
 const HttpGetVerb = "GET"
 const HttpPostVerb = "POST"
+const HttpPutVerb = "PUT"
+const HttpPatchVerb = "PATCH"
+const HttpDeleteVerb = "DELETE"
+
+/*
+** HEAD does not have its own handler map. When autoHead is set (the default, turned off with -auto-head=false), a
+**   HEAD request for a version that has no HEAD handlers is dispatched to the GET handler of the method with a
+**   headResponseWriter, so the response has the same status and headers as the GET but no body. When autoHead is
+**   not set, HEAD is an unsupported verb.
+** The GET handlers that change the state of the server (listed in the headExcludedMethods) are never run for a
+**   HEAD request, so a monitor probing with HEAD cannot, for example, shut the server down.
+ */
+const HttpHeadVerb = "HEAD"
+
+var autoHead = true
+var headExcludedMethods = map[string]bool{ShutdownMethod: true}
+
+/*
+** The headResponseWriter discards everything that is written to the body of the response. The status and headers
+**   are passed through to the wrapped ResponseWriter.
+ */
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Unwrap allows the http.ResponseController to reach the underlying connection (i.e. to set the read deadline)
+func (w headResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+/*
+** The following are the possible behaviors for a request with an empty method (i.e. "GET / HTTP/1.1"). The
+**   behavior is selected with the -empty-method flag and the redirect location with the -empty-method-redirect flag.
+**   EmptyMethodNotFound - respond with NOT_FOUND_404
+**   EmptyMethodIndex - respond with the list of supported HTTP verbs and methods
+**   EmptyMethodRedirect - respond with FOUND_302 to the configured location
+ */
+const EmptyMethodNotFound = "notfound"
+const EmptyMethodIndex = "index"
+const EmptyMethodRedirect = "redirect"
+
+var emptyMethodBehavior = EmptyMethodNotFound
+var emptyMethodRedirectLocation = "/stats"
+
+/*
+** The postStats holds the number of POST /hash requests that were handed an identifier and the summation of the
+**   time required for the POST /hash method handler for those requests. Both are updated together under the mu
+**   mutex (in measurePostTime()) and GET /stats copies the whole struct under the same mutex, so the snapshot it
+**   reports is always self-consistent (the average is always totalTime / total for the same set of requests).
+** The time is kept in nanoseconds and is converted to the unit selected by the -stats-unit flag prior to the
+**   returning of the stats data.
+**
+** To report the distribution, the minimum and maximum times are kept along with a ring buffer of the most recent
+**   PostTimeSampleSize times, which the p95 is computed from. The ring buffer keeps the memory used bounded under
+**   sustained load, at the cost of the p95 only covering the recent requests.
+ */
+const PostTimeSampleSize = 1024
+
+type postStatistics struct {
+	total     int64
+	totalTime int64
+	minTime   int64
+	maxTime   int64
+
+	recentTimes  [PostTimeSampleSize]int64
+	nextRecent   int
+	validRecents int
+}
+
+var postStats postStatistics
+
+/*
+** The following are the lifetime counters that are logged in the summary when the server exits. The
+**   lifetimeRequests is the number of requests that were dispatched to a handler (this does not include the
+**   requests rejected while shutting down) and the lifetimeErrors is the number of those requests that were
+**   responded to with each error status code. The lifetimeMutex protects both.
+ */
+var lifetimeMutex sync.Mutex
+var lifetimeRequests int64 = 0
+var lifetimeErrors = make(map[int]int64)
+var serverStartTime = time.Now()
+
+/*
+** The following are the supported units for the "average" reported by GET /stats. The unit is selected by the
+**   -stats-unit flag and is also returned in the "average_unit" field so clients do not need to guess.
+ */
+const StatsUnitNanoseconds = "ns"
+const StatsUnitMicroseconds = "us"
+const StatsUnitMilliseconds = "ms"
+
+var statsUnit = StatsUnitMicroseconds
+var statsUnitDivisors = map[string]int64{
+	StatsUnitNanoseconds:  int64(time.Nanosecond),
+	StatsUnitMicroseconds: int64(time.Microsecond),
+	StatsUnitMilliseconds: int64(time.Millisecond),
+}
 
 /*
-** The following is the summation of the time required for POST /hash method handler. This is updated
-**   under a mutex. This is also the time in milliseconds so there is some accuracy lost versus if this
-**   was kept in nanoseconds and then divided prior to the returning of the stats data.
+** The statsSemaphore limits the number of GET /stats requests that can be processed at the same time. The
+**   capacity is set from the -max-stats-concurrency flag in initialize(). Requests beyond the limit are
+**   responded to with SERVICE_UNAVAILABLE_503.
  */
-var totalTime int64 = 0
+var maxStatsConcurrency = 4
+
+/*
+** When statsIncludeRuntime is set (via the -stats-include-runtime flag), GET /stats also returns the number of
+**   goroutines and the number of open file descriptors (read from /proc/self/fd, so only on Linux).
+ */
+var statsIncludeRuntime = false
+var statsSemaphore chan struct{}
+
+/*
+** The initializeOnce guards the setup of the package level maps so that initialize() is safe to call more than once
+**   (and from multiple goroutines) if the server is embedded and started more than once.
+ */
+var initializeOnce sync.Once
 
 /*
 ** This is used to setup the different maps used to determine which handler to execute based upon the HTTP verb and
-**   the method.
+**   the method. Only the first call does the setup, any later calls wait for it to complete and then return.
  */
 func initialize() {
+	initializeOnce.Do(initializeHandlers)
+}
+
+/*
+** This does the actual setup for initialize(). It must only be called through initializeOnce.
+ */
+func initializeHandlers() {
 	/*
 	** First initialize anything the different method handlers required
 	 */
+	initializeFeatures()
 	initializeHash()
 
+	statsSemaphore = make(chan struct{}, maxStatsConcurrency)
+
 	/*
 	** Setup the handlers for the various HTTP verbs
 	 */
+	postHandlerMap[DrainMethod] = drain
 	postHandlerMap[HashMethod] = hash
+	postHandlerMap[ResumeMethod] = resume
 	postHandlerMap[ShutdownMethod] = shutdown
-	postHandlerMap[""] = unsupportedRequest
 
+	getHandlerMap[CapabilitiesMethod] = capabilities
+	getHandlerMap[DebugMethod] = debug
 	getHandlerMap[HashMethod] = hashWithQualifier
-	getHandlerMap[StatsMethod] = stats
 	getHandlerMap[ShutdownMethod] = shutdown
+	getHandlerMap[StatsMethod] = stats
+
+	deleteHandlerMap[HashMethod] = deleteHashedPassword
 
 	verbHttpMap[HttpGetVerb] = getHandlerMap
 	verbHttpMap[HttpPostVerb] = postHandlerMap
+	verbHttpMap[HttpPutVerb] = putHandlerMap
+	verbHttpMap[HttpPatchVerb] = patchHandlerMap
+	verbHttpMap[HttpDeleteVerb] = deleteHandlerMap
+
+	/*
+	** A request with an empty method (i.e. "PUT / HTTP/1.1") is handled the same way for every verb
+	 */
+	for _, handlerMap := range verbHttpMap {
+		handlerMap[""] = emptyMethodHandler
+	}
+
+	registerHealthHandlers()
+}
+
+/*
+** Registers the health check under the -health-path and each of the healthPathAliases.
+ */
+func registerHealthHandlers() {
+	registerGenericHandler(strings.TrimPrefix(healthPath, "/"), health)
+	for _, alias := range healthPathAliases {
+		registerGenericHandler(strings.TrimPrefix(alias, "/"), health)
+	}
+}
+
+/*
+** This is used to register a handler that will be called for the method regardless of the HTTP verb. A handler
+**   registered for the method in one of the verb specific maps takes precedence over the generic handler.
+ */
+func registerGenericHandler(method string, genericHandler func(http.ResponseWriter, *http.Request)) {
+	genericHandlerMap[method] = genericHandler
 }
 
 /*
@@ -97,12 +312,29 @@ func initialize() {
 **   difference but one that makes the behavior a bit easier to to track).
 ** The first check is to determine which map of handlers to use based upon the HTTP verb. Once that is done, then the
 **   code checks for the method (essentially split the string using the '/' token). The string following the first '/'
-**   is used to search the map for the appropriate handler.
+**   is used to search the map for the appropriate handler. If the verb specific map does not have a handler for the
+**   method (and the verb is supported), the genericHandlerMap is checked for a verb-agnostic handler.
+** If the path starts with an API version segment (i.e. "/v1/hash"), the verb maps for that version are used instead
+**   and the segment is stripped from the path before the dispatch (see apiVersion.go). A version that has no
+**   handlers registered is an unsupported request.
+** A HEAD request is dispatched to the GET handlers with the body discarded (see autoHead).
 **
-** NOTE: If the HTTP server needs to handle the case of an HTTP verb with an empty method (i.e. something
-**   like "GET / HTTP/1.1") the checking of the map will need to be use an empty string for the search string.
+** NOTE: An HTTP verb with an empty method (i.e. something like "GET / HTTP/1.1") is looked up in the maps using an
+**   empty string for the search string. The emptyMethodHandler is registered under the empty string for each verb.
+**
+** NOTE: The health check (liveness) requests are answered before any of this, so that they are not counted in the
+**   outstandingRequests and they keep succeeding while the shutdown is in progress, right up until the listener
+**   closes. The readiness requests are answered there as well, so they are not counted in the outstandingRequests.
  */
 func handler(w http.ResponseWriter, r *http.Request) {
+	if isHealthPath(r.URL.Path) {
+		health(w, r)
+		return
+	}
+	if r.URL.Path == ReadinessPath {
+		readiness(w, r)
+		return
+	}
 
 	/* DEBUG
 	fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL, r.Proto)
@@ -110,8 +342,50 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 	shuttingDown := incOutstandingAndCheckForShutdown()
 	if !shuttingDown {
-		// Parse the URL to see if anything needs to be processed
-		methodStrings := strings.Split(r.URL.RequestURI(), "/")
+		start := time.Now()
+
+		// Wrap the ResponseWriter so the status the sub-handler responds with can be recorded
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+
+		/*
+		** The bookkeeping for the request is deferred so that it is still done if the sub-handler panics. Otherwise
+		**   the panic would leave the outstandingRequests incremented and the shutdown would wait on it forever.
+		**   The panic is recovered (and turned into an INTERNAL_SERVER_ERROR_500) before the bookkeeping so that the
+		**   500 is what is recorded.
+		 */
+		var finishBodyAccounting func()
+		defer func() {
+			recovered := recover()
+			if recovered != nil {
+				recoverHandlerPanic(rec, r, recovered)
+			}
+
+			if finishBodyAccounting != nil {
+				finishBodyAccounting()
+			}
+
+			recordRequestSummary(r, rec.status, start)
+			logRequest(r, rec.status, rec.bytes, start)
+			recordLifetimeRequest(rec.status)
+			statsdRequest(r.Method, rec.status)
+
+			decOutstandingAndCheckForShutdown()
+
+			// The http server uses ErrAbortHandler to abort the response, so it is passed on once the bookkeeping is done
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+		}()
+
+		// Strip the API version segment (if there is one) off of the path. The versioned request (with the version
+		//   removed from the path) is what is passed to the sub-handler, the original is kept for the summary.
+		version, versioned, knownVersion := splitApiVersion(r)
+
+		// Parse the URL path to see if anything needs to be processed. The path is used rather than the RequestURI()
+		//   so that a query string (i.e. "/stats?foo=bar") does not end up as part of the method. Any query
+		//   parameters are left for the handlers to parse.
+		methodStrings := strings.Split(versioned.URL.Path, "/")
 
 		/* DEBUG
 		for i := range methodStrings {
@@ -129,27 +403,55 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		**   input string "/hash/1" -> results in three method strings, [0] is "", [1] is "hash", [3] is "1"
 		** Since the only URL strings that need to be handled, insure that there is at least two parsed out
 		**   method strings (due to the odd behavior of Split()).
+		**
+		** Prior to the dispatch, the client is checked to make sure it has not sent too many request body bytes in
+		**   the current window (in which case the TOO_MANY_REQUESTS_429 response has already been written), and the
+		**   registered authorizers are called (see RegisterAuthorizer()).
 		 */
-		if len(methodStrings) >= 2 {
+		finishBodyAccounting = accountBodyBytes(w, r)
+		if finishBodyAccounting == nil {
+			// Rejected by accountBodyBytes()
+		} else if !knownVersion {
+			unsupportedRequest(w, r)
+		} else if !authorizeRequest(w, versioned) {
+			// Rejected by one of the registered authorizers
+		} else if len(methodStrings) >= 2 {
 			var handlerMap map[string]func(http.ResponseWriter, *http.Request)
 
-			handlerMap = verbHttpMap[r.Method]
-			if handlerMap != nil {
-				// fmt.Printf("Map lookup - %s\n", methodStrings[1])
-				httpHandler := handlerMap[methodStrings[1]]
-				if httpHandler != nil {
-					httpHandler(w, r)
-				} else {
-					unsupportedRequest(w, r)
-				}
+			handlerMap = apiVersionMap[version][r.Method]
+			autoHeadRequest := handlerMap == nil && r.Method == HttpHeadVerb && autoHead
+			if autoHeadRequest {
+				handlerMap = apiVersionMap[version][HttpGetVerb]
+				w = headResponseWriter{ResponseWriter: w}
+			}
+
+			/*
+			** The genericHandlerMap is only used for the verbs that are supported (have a handler map). A HEAD request
+			**   that is answered by the GET handlers only uses the GET handlers, and never one that changes the state
+			**   of the server.
+			 */
+			// fmt.Printf("Map lookup - %s\n", methodStrings[1])
+			httpHandler := handlerMap[methodStrings[1]]
+			if autoHeadRequest && headExcludedMethods[methodStrings[1]] {
+				httpHandler = nil
+			} else if httpHandler == nil && handlerMap != nil && !autoHeadRequest {
+				httpHandler = genericHandlerMap[methodStrings[1]]
+			}
+
+			if httpHandler != nil && r.Method != HttpGetVerb && r.Method != HttpHeadVerb &&
+				isMethodDraining(methodStrings[1], strings.Join(methodStrings[2:], "/")) {
+				// SERVICE_UNAVAILABLE_503
+				writeError(w, http.StatusServiceUnavailable, "draining")
+			} else if httpHandler != nil {
+				httpHandler(w, versioned)
+			} else if handlerMap != nil {
+				unsupportedRequest(w, r)
 			} else {
 				verbNotSupported(w, r)
 			}
 		} else {
 			unsupportedRequest(w, r)
 		}
-
-		decOutstandingAndCheckForShutdown()
 	} else {
 		/*
 		** This is the code path when the shutdownRequested flag is set and the server is waiting for the
@@ -190,68 +492,469 @@ func decOutstandingAndCheckForShutdown() {
 	requestsMutex.Lock()
 	outstandingRequests--
 	if shutdownRequested && (outstandingRequests == 0) {
-		httpShutdownRequested.Done()
+		signalHttpShutdown()
 	}
 	requestsMutex.Unlock()
 }
 
+/*
+** This sets the shutdownRequested flag and records the reason for the shutdown. This is used by all of the different
+**   paths that can trigger the shutdown (the /shutdown method, signals and the HTTP server failing to start). If the
+**   shutdown has already been requested, this does nothing.
+ */
+func requestShutdown(reason string) {
+	requestsMutex.Lock()
+	if !shutdownRequested {
+		shutdownRequested = true
+		shutdownReason = reason
+		close(shutdownStarted)
+
+		/*
+		** Need to handle the case where there are no requests currently outstanding and the shutdown can happen
+		**   immediately.
+		 */
+		if outstandingRequests == 0 {
+			signalHttpShutdown()
+		}
+	}
+	requestsMutex.Unlock()
+}
+
+/*
+** Returns the channel that is closed when the shutdown is requested
+ */
+func shutdownStartedSignal() <-chan struct{} {
+	requestsMutex.Lock()
+	signal := shutdownStarted
+	requestsMutex.Unlock()
+
+	return signal
+}
+
+/*
+** Returns the reason recorded when the shutdown was requested
+ */
+func getShutdownReason() string {
+	requestsMutex.Lock()
+	reason := shutdownReason
+	requestsMutex.Unlock()
+
+	return reason
+}
+
+/*
+** Returns the number of requests that are still in flight
+ */
+func getOutstandingRequests() int32 {
+	requestsMutex.Lock()
+	outstanding := outstandingRequests
+	requestsMutex.Unlock()
+
+	return outstanding
+}
+
 /*
 ** Tis is the handler for the GET /stats request.
-**   It returns the number of calls to "POST /hash" and the average time for all of the calls
+**   It returns the number of calls to "POST /hash" and the average, minimum, maximum and p95 times for the calls
+**   (in the unit selected by the -stats-unit flag, the p95 only covers the most recent PostTimeSampleSize calls).
+**   It also returns the age of the oldest identifier that is still waiting for its hash (0 when none are pending)
+**   so that stuck hashing can be detected, and the number of requests in flight (which includes the GET /stats
+**   request itself).
  */
-func stats(w http.ResponseWriter, _ *http.Request) {
+func stats(w http.ResponseWriter, r *http.Request) {
+	/*
+	** Limit the number of concurrent GET /stats requests so that monitoring systems scraping the stats cannot
+	**   starve the POST /hash handlers of the mu mutex.
+	 */
+	select {
+	case statsSemaphore <- struct{}{}:
+		defer func() { <-statsSemaphore }()
+	default:
+		// SERVICE_UNAVAILABLE_503
+		writeError(w, http.StatusServiceUnavailable, "")
+		return
+	}
+
+	/*
+	** The mu and the requestsMutex are never held at the same time (each is released before the other is taken), so
+	**   there is no lock ordering between them to get wrong.
+	 */
 	mu.Lock()
-	tmp := count
-	avg := totalTime / int64(tmp)
+	snapshot := postStats
 	mu.Unlock()
 
-	n, err := fmt.Fprintf(w, "{\"total\": %d, \"average\": %d}\n", tmp, avg)
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
+	inflight := getOutstandingRequests()
+
+	divisor := statsUnitDivisors[statsUnit]
+
+	// Prior to the first POST /hash there is nothing to average, so the average is reported as 0
+	var avg int64 = 0
+	if snapshot.total > 0 {
+		avg = snapshot.totalTime / snapshot.total / divisor
+	}
+
+	response := statsResponse{
+		Total:              snapshot.total,
+		Average:            avg,
+		Min:                snapshot.minTime / divisor,
+		Max:                snapshot.maxTime / divisor,
+		P95:                percentile(snapshot.recentTimes[:snapshot.validRecents], 95) / divisor,
+		AverageUnit:        statsUnit,
+		OldestPendingAgeMs: oldestPendingAge(time.Now()).Milliseconds(),
+		Inflight:           inflight,
+	}
+
+	if statsIncludeRuntime {
+		goroutines := runtime.NumGoroutine()
+		response.Goroutines = &goroutines
+		if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+			openFds := len(fds)
+			response.OpenFds = &openFds
+		}
+	}
+
+	// If the write fails, the error is logged along with the request so it can be tracked down
+	if err := writeJSON(w, http.StatusOK, response); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "stats(2) writeJSON: %v (%s %s from %s)\n", err, r.Method, r.URL.Path, clientIP(r))
 	}
 }
 
+/*
+** Returns the percentile (nearest rank) of the times, or 0 if there are none. The times are copied prior to being
+**   sorted.
+ */
+func percentile(times []int64, p int) int64 {
+	if len(times) == 0 {
+		return 0
+	}
+
+	sorted := append([]int64(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := (len(sorted)*p + 99) / 100
+	return sorted[rank-1]
+}
+
+/*
+** The statsResponse is what is returned by GET /stats
+ */
+type statsResponse struct {
+	Total              int64  `json:"total"`
+	Average            int64  `json:"average"`
+	Min                int64  `json:"min"`
+	Max                int64  `json:"max"`
+	P95                int64  `json:"p95"`
+	AverageUnit        string `json:"average_unit"`
+	OldestPendingAgeMs int64  `json:"oldest_pending_age_ms"`
+	Inflight           int32  `json:"inflight"`
+	Goroutines         *int   `json:"goroutines,omitempty"`
+	OpenFds            *int   `json:"open_fds,omitempty"`
+}
+
+/*
+** This is the handler for the readiness check. It returns OK_200 while the server is running and
+**   SERVICE_UNAVAILABLE_503 once the shutdown has been requested (while the outstanding requests drain).
+ */
+func readiness(w http.ResponseWriter, _ *http.Request) {
+	requestsMutex.Lock()
+	shuttingDown := shutdownRequested
+	requestsMutex.Unlock()
+
+	if shuttingDown {
+		// SERVICE_UNAVAILABLE_503
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+
+	if err := writeJSON(w, http.StatusOK, map[string]string{"status": "ready"}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "readiness() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** Returns true if the path is the -health-path or one of the healthPathAliases.
+ */
+func isHealthPath(path string) bool {
+	if path == healthPath {
+		return true
+	}
+	for _, alias := range healthPathAliases {
+		if path == alias {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+** Returns true if the path is the path of a method that is registered for any verb of any API version (or is an API
+**   version segment), in which case the path cannot be used as the -health-path since the health check is answered
+**   before the dispatch and would hide the method. This must be called after initialize().
+ */
+func isMethodPath(path string) bool {
+	method := strings.TrimPrefix(path, "/")
+	if apiVersionSegment.MatchString(method) {
+		return true
+	}
+
+	for _, verbMap := range apiVersionMap {
+		for _, handlerMap := range verbMap {
+			if _, found := handlerMap[method]; found {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+** This is the handler for the health check. If the server is able to dispatch the request, it is healthy.
+ */
+func health(w http.ResponseWriter, _ *http.Request) {
+	if err := writeJSON(w, http.StatusOK, map[string]string{"status": "ok"}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "health() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** The capabilitiesResponse is what is returned by GET /capabilities. It is built from the current configuration
+**   of the server (and the features registry) so clients can adapt to the features that are enabled.
+ */
+type capabilitiesResponse struct {
+	Features       map[string]bool `json:"features"`
+	TLS            bool            `json:"tls"`
+	Algos          []string        `json:"algos"`
+	SyncHash       bool            `json:"sync_hash"`
+	MaxPasswordLen int             `json:"max_password_len"`
+	GzipBodies     bool            `json:"gzip_bodies"`
+	ReadOnly       bool            `json:"read_only"`
+	Debug          bool            `json:"debug"`
+	StatsUnit      string          `json:"stats_unit"`
+}
+
+/*
+** This is the handler for the GET /capabilities request. It returns which features are enabled in the server.
+ */
+func capabilities(w http.ResponseWriter, _ *http.Request) {
+	response := capabilitiesResponse{
+		Features:       features.Snapshot(),
+		TLS:            features.Enabled(FeatureTLS),
+		Algos:          supportedHashAlgorithms(),
+		SyncHash:       false,
+		MaxPasswordLen: maxPasswordLength,
+		GzipBodies:     features.Enabled(FeatureGzip),
+		ReadOnly:       features.Enabled(FeatureReadOnly),
+		Debug:          features.Enabled(FeatureDebug),
+		StatsUnit:      statsUnit,
+	}
+
+	if err := writeJSON(w, http.StatusOK, response); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "capabilities() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** Counts a request that was dispatched by the central handler in the lifetime counters.
+ */
+func recordLifetimeRequest(status int) {
+	lifetimeMutex.Lock()
+	lifetimeRequests++
+	if status >= http.StatusBadRequest {
+		lifetimeErrors[status]++
+	}
+	lifetimeMutex.Unlock()
+}
+
+/*
+** Returns a single line summary of the lifetime of the server: the total number of requests, the number of hashes,
+**   the average POST /hash time, the number of errors by status code and the uptime.
+ */
+func lifetimeSummary() string {
+	mu.Lock()
+	snapshot := postStats
+	mu.Unlock()
+
+	var average int64 = 0
+	if snapshot.total > 0 {
+		average = snapshot.totalTime / snapshot.total / statsUnitDivisors[statsUnit]
+	}
+
+	lifetimeMutex.Lock()
+	requests := lifetimeRequests
+	codes := make([]int, 0, len(lifetimeErrors))
+	for code := range lifetimeErrors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	errorCounts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		errorCounts = append(errorCounts, fmt.Sprintf("%d:%d", code, lifetimeErrors[code]))
+	}
+	lifetimeMutex.Unlock()
+
+	return fmt.Sprintf("requests=%d hashes=%d average=%d%s errors=[%s] uptime=%s", requests, snapshot.total,
+		average, statsUnit, strings.Join(errorCounts, " "), time.Since(serverStartTime).Round(time.Second))
+}
+
 /*
 ** The shutdown() handler is pretty simple in that is just sets a flag that is checked whenever a new
 **   request comes in. If there are not request currently being worked on, it will proceed with the
-**   shutdown immediately (via the httpShutdownRequest wait signal).
+**   shutdown immediately (via the httpShutdownRequested channel).
 ** This will always return OK_200.
  */
 func shutdown(w http.ResponseWriter, _ *http.Request) {
-	requestsMutex.Lock()
-	shutdownRequested = true
+	requestShutdown(ShutdownReasonClient)
 
-	/*
-	** Need to handle the case where there are no requests currently outstanding and the shutdown can happen
-	**   immediately.
-	 */
-	if outstandingRequests == 0 {
-		httpShutdownRequested.Done()
+	// OK_200
+	if err := writeJSON(w, http.StatusOK, map[string]int{"response": http.StatusOK}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "shutdown() writeJSON: %v\n", err)
 	}
+}
 
-	requestsMutex.Unlock()
+/*
+** The maximum number of bytes of the goroutine stack that is logged when a sub-handler panics.
+ */
+const PanicStackSize = 64 * 1024
 
-	// OK_200
-	n, err := fmt.Fprintf(w, "{\"response\": 200}\n")
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
+/*
+** This is called by the central handler when a sub-handler panics. The panic and the stack are logged, and if the
+**   sub-handler had not started the response yet, INTERNAL_SERVER_ERROR_500 is returned. If it had, the status has
+**   already been sent, so only the status that is recorded is changed to the 500.
+ */
+func recoverHandlerPanic(rec *statusRecorder, r *http.Request, recovered interface{}) {
+	if recovered == http.ErrAbortHandler {
+		return
+	}
+
+	stack := make([]byte, PanicStackSize)
+	stack = stack[:runtime.Stack(stack, false)]
+	log.Printf("handler: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, recovered, stack)
+
+	if rec.wroteHeader {
+		rec.status = http.StatusInternalServerError
+		return
 	}
 
+	// INTERNAL_SERVER_ERROR_500
+	writeError(rec, http.StatusInternalServerError, "internal error")
+}
+
+/*
+** The failRequestResponse is the body returned by failRequest() in the ErrorFormatNumeric format. The Remaining is
+**   the number of outstandingRequests that the shutdown is still waiting on.
+ */
+type failRequestResponse struct {
+	Error     int   `json:"error"`
+	Draining  bool  `json:"draining"`
+	Remaining int32 `json:"remaining"`
 }
 
 /*
 ** The following handler is used while the number of outstandingRequests ic counting down and a new request has been
 **   received (this is after the shutdownRequested flag has been set). It tells the client the service is
-**   no longer available.
+**   no longer available, along with how many requests are still being drained so the progress of the shutdown
+**   can be followed.
  */
 func failRequest(w http.ResponseWriter, _ *http.Request) {
+	remaining := getOutstandingRequests()
+
 	// SERVICE_UNAVAILABLE_503
-	n, err := fmt.Fprintf(w, "{\"error\": 503}\n")
+	if errorFormat == ErrorFormatProblem {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("draining, %d requests remaining", remaining))
+		return
+	}
+
+	response := failRequestResponse{Error: http.StatusServiceUnavailable, Draining: true, Remaining: remaining}
+	if err := writeJSON(w, http.StatusServiceUnavailable, response); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failRequest() writeJSON: %v\n", err)
+	}
+}
+
+/*
+** The following are the supported formats for the error responses. The format is selected with the -error-format
+**   flag.
+**   ErrorFormatNumeric - the body is {"error": <status>} (plus a "detail" field if there is one)
+**   ErrorFormatProblem - the body is an RFC 7807 application/problem+json object
+ */
+const ErrorFormatNumeric = "numeric"
+const ErrorFormatProblem = "problem"
+
+var errorFormat = ErrorFormatNumeric
+
+/*
+** The problemDetails is the RFC 7807 representation of an error response
+ */
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+/*
+** The numericError is the body of the error responses in the ErrorFormatNumeric format
+ */
+type numericError struct {
+	Error  int    `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+/*
+** All of the error responses are written through this function so that the format of the error is consistent. The
+**   detail is optional additional information about the error and is not included if it is empty.
+** The HTTP status is set to the error status in both formats.
+ */
+func writeError(w http.ResponseWriter, status int, detail string) {
+	var err error
+
+	if errorFormat == ErrorFormatProblem {
+		problem := problemDetails{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: detail,
+		}
+		err = writeJSONWithType(w, status, "application/problem+json", problem)
+	} else {
+		err = writeJSON(w, status, numericError{Error: status, Detail: detail})
+	}
+
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
+		_, _ = fmt.Fprintf(os.Stderr, "writeError() writeJSON: %v\n", err)
 	}
 }
 
+/*
+** All of the JSON responses are written through this function so that they have the application/json Content-Type
+**   and are wrapped in the response templates (see responseTemplates.go).
+**   The response is encoded completely prior to writing anything, so the status and the body are written with a
+**   single Write() (the status must be written prior to the body, since writing the body implicitly sends OK_200).
+ */
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	return writeJSONWithType(w, status, "application/json", v)
+}
+
+func writeJSONWithType(w http.ResponseWriter, status int, contentType string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Wrap the body in the -success-template or -error-template (if they are set)
+	body, err = applyResponseTemplate(status, v, body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
 /*
 ** This is used when the HTTP verb is supported, but the method the client requested is not supported
 **   by the server. It returns a simple error of METHOD_NOT_ALLOWED_405 to the client.
@@ -259,22 +962,84 @@ func failRequest(w http.ResponseWriter, _ *http.Request) {
 func unsupportedRequest(w http.ResponseWriter, _ *http.Request) {
 	// METHOD_NOT_ALLOWED_405
 	//fmt.Printf("unsupportedRequest\n")
-	n, err := fmt.Fprintf(w, "{\"error\": 405}\n")
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
-	}
+	writeError(w, http.StatusMethodNotAllowed, "")
+}
+
+/*
+** The verbNotSupportedResponse is the body returned by verbNotSupported() in the ErrorFormatNumeric format
+ */
+type verbNotSupportedResponse struct {
+	Error int      `json:"error"`
+	Allow []string `json:"allow"`
 }
 
 /*
 ** This function is called when the HTTP verb passed into the top level handler method does not match any of the
 **   supported verbs.
-** This returns the METHOD_NOT_ALLOWED_405 and the list of supported HTTP verbs.
+** This returns the METHOD_NOT_ALLOWED_405 and the list of supported HTTP verbs (taken from the verb map for the API
+**   version of the request), both in the body and in the Allow header.
  */
-func verbNotSupported(w http.ResponseWriter, _ *http.Request) {
+func verbNotSupported(w http.ResponseWriter, r *http.Request) {
+	version, _, _ := splitApiVersion(r)
+
+	var verbs []string
+	for verb := range apiVersionMap[version] {
+		verbs = append(verbs, verb)
+	}
+	if _, found := apiVersionMap[version][HttpGetVerb]; found && autoHead {
+		verbs = append(verbs, HttpHeadVerb)
+	}
+	sort.Strings(verbs)
+
 	// METHOD_NOT_ALLOWED_405
-	n, err := fmt.Fprintf(w, "{\n  {\"error\": 405},\n  {\"Allow\": GET POST}\n}\n")
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Fprintf: %d %v\n", n, err)
+	w.Header().Set("Allow", strings.Join(verbs, ", "))
+	if errorFormat == ErrorFormatProblem {
+		writeError(w, http.StatusMethodNotAllowed, "allowed HTTP verbs: "+strings.Join(verbs, " "))
+		return
+	}
+
+	response := verbNotSupportedResponse{Error: http.StatusMethodNotAllowed, Allow: verbs}
+	if err := writeJSON(w, http.StatusMethodNotAllowed, response); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "verbNotSupported() writeJSON: %v\n", err)
 	}
 }
 
+/*
+** This is the handler registered under the empty method for each of the supported HTTP verbs. What it does is
+**   controlled by the -empty-method flag (see the EmptyMethod... constants).
+ */
+func emptyMethodHandler(w http.ResponseWriter, r *http.Request) {
+	switch emptyMethodBehavior {
+	case EmptyMethodIndex:
+		returnApiIndex(w)
+	case EmptyMethodRedirect:
+		http.Redirect(w, r, emptyMethodRedirectLocation, http.StatusFound)
+	default:
+		// NOT_FOUND_404
+		writeError(w, http.StatusNotFound, "")
+	}
+}
+
+/*
+** Returns the API index, which is the sorted list of "<verb> /<method>" strings built from the handler maps.
+ */
+func returnApiIndex(w http.ResponseWriter) {
+	var endpoints []string
+
+	for verb, handlerMap := range verbHttpMap {
+		for method := range handlerMap {
+			if method == "" || (method == DebugMethod && !features.Enabled(FeatureDebug)) {
+				continue
+			}
+			endpoints = append(endpoints, verb+" /"+method)
+		}
+	}
+	for method := range genericHandlerMap {
+		endpoints = append(endpoints, "* /"+method)
+	}
+	sort.Strings(endpoints)
+
+	if err := writeJSON(w, http.StatusOK, map[string][]string{"endpoints": endpoints}); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "returnApiIndex() writeJSON: %v\n", err)
+	}
+}
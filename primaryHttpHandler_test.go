@@ -0,0 +1,669 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+** /shutdown is only supported for GET and POST. The other verbs (including HEAD, which is otherwise answered by
+**   the GET handlers) must not fall back to a handler that shuts the server down.
+ */
+func TestShutdownOnlyForGetAndPost(t *testing.T) {
+	unsupported := []string{http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	for _, verb := range unsupported {
+		w := request(verb, "/shutdown", "")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s /shutdown: status %d, want %d", verb, w.Code, http.StatusMethodNotAllowed)
+		}
+		if reason := getShutdownReason(); reason != "" {
+			t.Fatalf("%s /shutdown started the shutdown (reason %q)", verb, reason)
+		}
+	}
+
+	for _, verb := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(verb, func(t *testing.T) {
+			t.Cleanup(func() { resetShutdownState() })
+
+			w := request(verb, "/shutdown", "")
+			if w.Code != http.StatusOK {
+				t.Errorf("%s /shutdown: status %d, want %d", verb, w.Code, http.StatusOK)
+			}
+			if reason := getShutdownReason(); reason != ShutdownReasonClient {
+				t.Errorf("%s /shutdown: shutdown reason %q, want %q", verb, reason, ShutdownReasonClient)
+			}
+		})
+	}
+}
+
+/*
+** A handler registered with registerGenericHandler() is reached with both GET and POST (which have verb maps that
+**   do not have the method), and a handler registered for the method in a verb map takes precedence over it.
+ */
+func TestGenericHandler(t *testing.T) {
+	var verbs []string
+	registerGenericHandler("generic", func(w http.ResponseWriter, r *http.Request) {
+		verbs = append(verbs, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	t.Cleanup(func() { delete(genericHandlerMap, "generic") })
+
+	for _, verb := range []string{http.MethodGet, http.MethodPost} {
+		if w := request(verb, "/generic", ""); w.Code != http.StatusNoContent {
+			t.Errorf("%s /generic: status %d, want %d", verb, w.Code, http.StatusNoContent)
+		}
+	}
+	if strings.Join(verbs, ",") != "GET,POST" {
+		t.Errorf("the generic handler was called for %v, want GET and POST", verbs)
+	}
+
+	registerGetHandlerForTest(t, "generic", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	if w := request(http.MethodGet, "/generic", ""); w.Code != http.StatusAccepted {
+		t.Errorf("GET /generic with a GET handler: status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if w := request(http.MethodPost, "/generic", ""); w.Code != http.StatusNoContent || len(verbs) != 3 {
+		t.Errorf("POST /generic with a GET handler: status %d, want %d from the generic handler", w.Code,
+			http.StatusNoContent)
+	}
+}
+
+/*
+** The -health-path cannot hide one of the methods, since the health check is answered before the dispatch.
+ */
+func TestIsMethodPath(t *testing.T) {
+	methodPaths := []string{"/hash", "/stats", "/shutdown", "/capabilities", "/debug", "/drain", "/resume", "/v1", "/v2"}
+	for _, path := range methodPaths {
+		if !isMethodPath(path) {
+			t.Errorf("isMethodPath(%q) = false, want true", path)
+		}
+	}
+
+	for _, path := range []string{"/health", "/healthz", "/livez", "/ping"} {
+		if isMethodPath(path) {
+			t.Errorf("isMethodPath(%q) = true, want false", path)
+		}
+	}
+}
+
+/*
+** The health check answers on a -health-path other than the default and on each of the aliases (including one that
+**   is added), while the default path is no longer the health check.
+ */
+func TestHealthPathAndAliases(t *testing.T) {
+	// registered first so that it runs once the -health-path and the aliases have been put back
+	t.Cleanup(func() {
+		delete(genericHandlerMap, "ping")
+		delete(genericHandlerMap, "alive")
+		registerHealthHandlers()
+	})
+	setForTest(t, &healthPath, "/ping")
+	setForTest(t, &healthPathAliases, append([]string{"/alive"}, healthPathAliases...))
+	registerHealthHandlers()
+
+	for _, path := range []string{"/ping", "/alive", "/healthz", "/livez"} {
+		if w := request(http.MethodGet, path, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d, want %d", path, w.Code, http.StatusOK)
+		}
+	}
+	if w := request(http.MethodGet, "/v1/ping", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /v1/ping: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	delete(genericHandlerMap, "health")
+	if w := request(http.MethodGet, "/health", ""); w.Code == http.StatusOK {
+		t.Errorf("GET /health with -health-path /ping: status %d, want it to not be the health check", w.Code)
+	}
+}
+
+/*
+** While the shutdown drains, the requests are rejected with a 503 body that includes the number of requests that are
+**   still outstanding.
+ */
+func TestShutdownReportsRemaining(t *testing.T) {
+	// two requests that are still in progress when the shutdown starts
+	incOutstandingAndCheckForShutdown()
+	incOutstandingAndCheckForShutdown()
+	startShutdownForTest(t)
+	t.Cleanup(func() {
+		decOutstandingAndCheckForShutdown()
+		decOutstandingAndCheckForShutdown()
+	})
+
+	w := request(http.MethodGet, "/stats", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /stats: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	var response failRequestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("body %q: %v", w.Body.String(), err)
+	}
+	if response.Error != http.StatusServiceUnavailable || !response.Draining || response.Remaining != 2 {
+		t.Errorf("body %q, want error 503, draining true and remaining 2", w.Body.String())
+	}
+}
+
+/*
+** HEAD is answered by the GET handler: the status and the headers are the same as for GET, but there is no body.
+ */
+func TestHeadStats(t *testing.T) {
+	get := request(http.MethodGet, "/stats", "")
+	head := request(http.MethodHead, "/stats", "")
+
+	if head.Code != http.StatusOK {
+		t.Errorf("HEAD /stats: status %d, want %d", head.Code, http.StatusOK)
+	}
+	if contentType := head.Header().Get("Content-Type"); contentType != get.Header().Get("Content-Type") ||
+		contentType == "" {
+		t.Errorf("HEAD /stats: Content-Type %q, want %q", contentType, get.Header().Get("Content-Type"))
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD /stats: body %q, want none", head.Body.String())
+	}
+}
+
+/*
+** Registers the handler for GET /<method> for the duration of the test.
+ */
+func registerGetHandlerForTest(t *testing.T, method string, getHandler func(http.ResponseWriter, *http.Request)) {
+	t.Helper()
+
+	getHandlerMap[method] = getHandler
+	t.Cleanup(func() { delete(getHandlerMap, method) })
+}
+
+/*
+** A handler that panics gets INTERNAL_SERVER_ERROR_500, the outstanding requests go back to where they were and the
+**   server keeps answering requests.
+ */
+func TestHandlerPanicIsRecovered(t *testing.T) {
+	registerGetHandlerForTest(t, "panic", func(http.ResponseWriter, *http.Request) {
+		panic("deliberate panic")
+	})
+
+	before := getOutstandingRequests()
+	w := request(http.MethodGet, "/panic", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("GET /panic: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if after := getOutstandingRequests(); after != before {
+		t.Errorf("outstanding requests %d after the panic, want %d", after, before)
+	}
+
+	if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /stats after the panic: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** GET /readyz returns OK_200 while the server is running and SERVICE_UNAVAILABLE_503 once the shutdown starts, while
+**   the health check keeps returning OK_200.
+ */
+func TestReadinessDuringShutdown(t *testing.T) {
+	if w := request(http.MethodGet, ReadinessPath, ""); w.Code != http.StatusOK {
+		t.Errorf("GET %s while running: status %d, want %d", ReadinessPath, w.Code, http.StatusOK)
+	}
+
+	startShutdownForTest(t)
+
+	if w := request(http.MethodGet, ReadinessPath, ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET %s during the shutdown: status %d, want %d", ReadinessPath, w.Code, http.StatusServiceUnavailable)
+	}
+	if w := request(http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /health during the shutdown: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** Starts the test with empty POST /hash statistics (as on a fresh server). The statistics are put back once the test
+**   is done.
+ */
+func resetPostStatsForTest(t *testing.T) {
+	t.Helper()
+
+	mu.Lock()
+	original := postStats
+	postStats = postStatistics{}
+	mu.Unlock()
+	t.Cleanup(func() {
+		pendingHashes.Wait()
+		mu.Lock()
+		postStats = original
+		mu.Unlock()
+	})
+}
+
+/*
+** Returns the GET /stats response.
+ */
+func getStats(t *testing.T) statsResponse {
+	t.Helper()
+
+	w := request(http.MethodGet, "/stats", "")
+	var response statsResponse
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /stats: status %d, body %q", w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET /stats: body %q: %v", w.Body.String(), err)
+	}
+	return response
+}
+
+/*
+** GET /stats on a server that has not hashed anything yet reports a total and an average of 0.
+ */
+func TestStatsOnFreshServer(t *testing.T) {
+	resetPostStatsForTest(t)
+
+	w := request(http.MethodGet, "/stats", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /stats: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("GET /stats: body %q: %v", w.Body.String(), err)
+	}
+	if response["total"] != float64(0) || response["average"] != float64(0) {
+		t.Errorf("GET /stats: body %q, want a total and an average of 0", w.Body.String())
+	}
+}
+
+/*
+** With -stats-include-runtime, GET /stats also returns the goroutines and the open file descriptors (the latter only
+**   where /proc/self/fd exists). Without it, neither field is present.
+ */
+func TestStatsIncludeRuntime(t *testing.T) {
+	setForTest(t, &statsIncludeRuntime, true)
+
+	response := getStats(t)
+	if response.Goroutines == nil || *response.Goroutines <= 0 {
+		t.Errorf("goroutines %v, want a count", response.Goroutines)
+	}
+	if _, err := os.Stat("/proc/self/fd"); err == nil && (response.OpenFds == nil || *response.OpenFds <= 0) {
+		t.Errorf("open_fds %v, want a count", response.OpenFds)
+	}
+
+	statsIncludeRuntime = false
+	if response := getStats(t); response.Goroutines != nil || response.OpenFds != nil {
+		t.Errorf("goroutines %v and open_fds %v without -stats-include-runtime, want neither", response.Goroutines,
+			response.OpenFds)
+	}
+}
+
+/*
+** Every POST /hash time is recorded as (just over) 1000 seconds while GET /stats runs concurrently (run with -race).
+**   The average of every snapshot must be that time: a snapshot that counted a request without its time (or the
+**   other way around) would be off by a whole request.
+ */
+func TestStatsSnapshotIsConsistent(t *testing.T) {
+	const recorded = 1000 * time.Second
+	resetPostStatsForTest(t)
+	setForTest(t, &statsUnit, StatsUnitMilliseconds)
+
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				measurePostTime(time.Now().Add(-recorded).UnixNano())
+			}
+		}()
+	}
+
+	minimum, maximum := recorded.Milliseconds(), (recorded + time.Second).Milliseconds()
+	done := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(done)
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		response := getStats(t)
+		if response.Total == 0 {
+			continue
+		}
+		if response.Average < minimum || response.Average > maximum {
+			t.Fatalf("total %d, average %dms, want between %dms and %dms", response.Total, response.Average, minimum,
+				maximum)
+		}
+	}
+
+	if response := getStats(t); response.Total != 800 {
+		t.Errorf("total %d, want 800", response.Total)
+	}
+}
+
+/*
+** With -empty-method=index, each of the verbs sent to / returns the API index. The other behaviors return
+**   NOT_FOUND_404 or redirect, again for each of the verbs.
+ */
+func TestEmptyMethod(t *testing.T) {
+	setForTest(t, &emptyMethodBehavior, EmptyMethodIndex)
+	verbs := []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+	for _, verb := range verbs {
+		w := request(verb, "/", "")
+		var index map[string][]string
+		if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s /: status %d, body %q", verb, w.Code, w.Body.String())
+		}
+		endpoints := strings.Join(index["endpoints"], ",")
+		for _, endpoint := range []string{"POST /hash", "GET /hash", "GET /stats", "POST /shutdown"} {
+			if !strings.Contains(endpoints, endpoint) {
+				t.Errorf("%s /: the index %q does not have %q", verb, endpoints, endpoint)
+			}
+		}
+	}
+
+	emptyMethodBehavior = EmptyMethodNotFound
+	for _, verb := range verbs {
+		if w := request(verb, "/", ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s / with notfound: status %d, want %d", verb, w.Code, http.StatusNotFound)
+		}
+	}
+
+	emptyMethodBehavior = EmptyMethodRedirect
+	for _, verb := range verbs {
+		if w := request(verb, "/", ""); w.Code != http.StatusFound ||
+			w.Header().Get("Location") != emptyMethodRedirectLocation {
+			t.Errorf("%s / with redirect: status %d, Location %q", verb, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+/*
+** Once -max-stats-concurrency GET /stats requests are in progress, the next one gets SERVICE_UNAVAILABLE_503. The
+**   requests in progress are held up by holding the mu mutex that they need.
+ */
+func TestStatsConcurrencyLimit(t *testing.T) {
+	mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			mu.Unlock()
+		}
+	}()
+
+	statuses := make(chan int, cap(statsSemaphore))
+	for i := 0; i < cap(statsSemaphore); i++ {
+		go func() { statuses <- request(http.MethodGet, "/stats", "").Code }()
+	}
+	for deadline := time.Now().Add(time.Second); len(statsSemaphore) < cap(statsSemaphore); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d GET /stats requests in progress", len(statsSemaphore), cap(statsSemaphore))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /stats over the limit: status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	mu.Unlock()
+	locked = false
+	for i := 0; i < cap(statsSemaphore); i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("GET /stats within the limit: status %d, want %d", status, http.StatusOK)
+		}
+	}
+	if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /stats once the others are done: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+** The GET /stats times are scaled to the -stats-unit, which is also returned in the "average_unit".
+ */
+func TestStatsUnits(t *testing.T) {
+	resetPostStatsForTest(t)
+	mu.Lock()
+	postStats.total = 2
+	postStats.totalTime = int64(3 * time.Millisecond)
+	postStats.minTime = int64(time.Millisecond)
+	postStats.maxTime = int64(2 * time.Millisecond)
+	mu.Unlock()
+	setForTest(t, &statsUnit, statsUnit)
+
+	for unit, want := range map[string]int64{
+		StatsUnitNanoseconds:  1500000,
+		StatsUnitMicroseconds: 1500,
+		StatsUnitMilliseconds: 1,
+	} {
+		statsUnit = unit
+		response := getStats(t)
+		if response.AverageUnit != unit || response.Average != want {
+			t.Errorf("-stats-unit=%s: average %d %s, want %d %s", unit, response.Average, response.AverageUnit, want,
+				unit)
+		}
+		if divisor := statsUnitDivisors[unit]; response.Min != int64(time.Millisecond)/divisor ||
+			response.Max != int64(2*time.Millisecond)/divisor {
+			t.Errorf("-stats-unit=%s: min %d and max %d", unit, response.Min, response.Max)
+		}
+	}
+}
+
+/*
+** The min, max and p95 reported by GET /stats come from the recorded latencies, and percentile() uses the nearest
+**   rank.
+ */
+func TestStatsDistribution(t *testing.T) {
+	for _, tc := range []struct {
+		times []int64
+		p     int
+		want  int64
+	}{
+		{nil, 95, 0},
+		{[]int64{7}, 95, 7},
+		{[]int64{3, 1, 2}, 50, 2},
+		{[]int64{3, 1, 2}, 95, 3},
+		{[]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 95, 19},
+	} {
+		if got := percentile(tc.times, tc.p); got != tc.want {
+			t.Errorf("percentile(%v, %d) = %d, want %d", tc.times, tc.p, got, tc.want)
+		}
+	}
+
+	resetPostStatsForTest(t)
+	setForTest(t, &statsUnit, StatsUnitMicroseconds)
+
+	// The latencies 10us..1ms in steps of 10us (in a shuffled order), so the p95 is the 95th of the 100 values
+	for i := int64(0); i < 100; i++ {
+		elapsed := ((i*37)%100 + 1) * int64(10*time.Microsecond)
+		measurePostTime(time.Now().UnixNano() - elapsed)
+	}
+
+	response := getStats(t)
+	if response.Total != 100 {
+		t.Fatalf("total %d, want 100", response.Total)
+	}
+	// The elapsed time also includes the time taken by measurePostTime(), so allow for a little slack
+	for name, check := range map[string]struct{ got, want int64 }{
+		"min":     {response.Min, 10},
+		"max":     {response.Max, 1000},
+		"p95":     {response.P95, 950},
+		"average": {response.Average, 505},
+	} {
+		if check.got < check.want || check.got > check.want+5 {
+			t.Errorf("%s %d us, want %d us", name, check.got, check.want)
+		}
+	}
+}
+
+/*
+** GET /capabilities reports the configured features.
+ */
+func TestCapabilities(t *testing.T) {
+	setForTest(t, &maxPasswordLength, 64)
+	setForTest(t, &statsUnit, StatsUnitMilliseconds)
+	setFeatureForTest(t, FeatureDebug, true)
+	setFeatureForTest(t, FeatureTLS, false)
+
+	capabilities := getCapabilities(t)
+	if strings.Join(capabilities.Algos, ",") != "sha256,sha384,sha512" {
+		t.Errorf("algos %v, want sha256, sha384 and sha512", capabilities.Algos)
+	}
+	if capabilities.MaxPasswordLen != 64 || capabilities.StatsUnit != StatsUnitMilliseconds {
+		t.Errorf("max_password_len %d and stats_unit %q, want 64 and %q", capabilities.MaxPasswordLen,
+			capabilities.StatsUnit, StatsUnitMilliseconds)
+	}
+	if !capabilities.Debug || capabilities.TLS || capabilities.SyncHash {
+		t.Errorf("debug %t, tls %t and sync_hash %t, want true, false and false", capabilities.Debug, capabilities.TLS,
+			capabilities.SyncHash)
+	}
+	for feature, enabled := range features.Snapshot() {
+		if capabilities.Features[feature] != enabled {
+			t.Errorf("feature %s is %t, want %t", feature, capabilities.Features[feature], enabled)
+		}
+	}
+}
+
+/*
+** The failingWriter accepts the first limit bytes of the body and then fails the write.
+ */
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit  int
+	writes int
+}
+
+func (f *failingWriter) Write(b []byte) (int, error) {
+	f.writes++
+	if len(b) > f.limit {
+		n, _ := f.ResponseRecorder.Write(b[:f.limit])
+		f.limit -= n
+		return n, errors.New("connection reset")
+	}
+	f.limit -= len(b)
+	return f.ResponseRecorder.Write(b)
+}
+
+/*
+** Returns what the function wrote to os.Stderr.
+ */
+func captureStderr(t *testing.T, function func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	original := os.Stderr
+	os.Stderr = writer
+	function()
+	os.Stderr = original
+	_ = writer.Close()
+
+	captured, _ := io.ReadAll(reader)
+	_ = reader.Close()
+	return string(captured)
+}
+
+/*
+** GET /stats writes its whole body with a single Write, and a failed write is logged along with the request.
+ */
+func TestStatsWriteFailureIsLogged(t *testing.T) {
+	w := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: 10}
+	r := newRequest(http.MethodGet, "/stats", "")
+
+	logged := captureStderr(t, func() { stats(w, r) })
+	if w.writes != 1 {
+		t.Errorf("%d writes, want 1", w.writes)
+	}
+	if !strings.Contains(logged, "stats(2) writeJSON: connection reset (GET /stats from 192.0.2.1)") {
+		t.Errorf("logged %q, want the write error and the request", logged)
+	}
+}
+
+/*
+** With -error-format=problem the error responses are application/problem+json objects with the type, title, status
+**   and detail of RFC 7807. The default numeric format returns {"error": <status>} as application/json.
+ */
+func TestProblemErrorFormat(t *testing.T) {
+	w := request(http.MethodGet, "/unknown", "")
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("numeric format: Content-Type %q, want application/json", contentType)
+	}
+	var numeric numericError
+	if err := json.Unmarshal(w.Body.Bytes(), &numeric); err != nil || numeric.Error != http.StatusMethodNotAllowed {
+		t.Errorf("numeric format: body %q, want {\"error\": %d}", w.Body.String(), http.StatusMethodNotAllowed)
+	}
+
+	setForTest(t, &errorFormat, ErrorFormatProblem)
+	for _, test := range []struct {
+		verb   string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/unknown", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/hash", "password=", http.StatusPreconditionFailed},
+		{http.MethodGet, "/hash/notanumber", "", http.StatusUnprocessableEntity},
+	} {
+		w := request(test.verb, test.target, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.verb, test.target, w.Code, test.status)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+			t.Errorf("%s %s: Content-Type %q, want application/problem+json", test.verb, test.target, contentType)
+		}
+
+		var problem map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("%s %s: body %q: %v", test.verb, test.target, w.Body.String(), err)
+		}
+		if problem["type"] != "about:blank" || problem["title"] != http.StatusText(test.status) ||
+			problem["status"] != float64(test.status) {
+			t.Errorf("%s %s: body %q, want the type, title and status of a %d", test.verb, test.target,
+				w.Body.String(), test.status)
+		}
+		if _, found := problem["error"]; found {
+			t.Errorf("%s %s: body %q has the numeric error field", test.verb, test.target, w.Body.String())
+		}
+	}
+
+	startShutdownForTest(t)
+	w = request(http.MethodGet, "/stats", "")
+	var problem problemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || problem.Status != http.StatusServiceUnavailable ||
+		!strings.Contains(problem.Detail, "draining") {
+		t.Errorf("GET /stats during the shutdown: body %q, want a draining problem", w.Body.String())
+	}
+}
+
+/*
+** The method is looked up from the path of the URL, so a query string does not change which handler the request is
+**   dispatched to.
+ */
+func TestRoutingIgnoresQuery(t *testing.T) {
+	if w := request(http.MethodGet, "/stats?foo=bar", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /stats?foo=bar: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w := request(http.MethodPost, "/hash?x=1", "password=angryMonkey")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /hash?x=1: status %d, want %d", w.Code, http.StatusOK)
+	}
+	identifier := strings.TrimSpace(w.Body.String())
+	if w := waitForHashed(t, identifier+"?x=1"); w.Code != http.StatusOK {
+		t.Errorf("GET /hash/%s?x=1: status %d, want %d", identifier, w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+/*
+** The authorizers are an extension point for the servers that embed this one to plug in their own authorization
+**   (i.e. OAuth token introspection or checks on the mTLS client certificate). Each authorizer registered with
+**   RegisterAuthorizer() is called, in the order they were registered, by the central handler prior to the dispatch
+**   of every request. The request is rejected as soon as one of them returns an error:
+**   UNAUTHORIZED_401 - the error is (or wraps) ErrUnauthenticated, the client did not prove who it is
+**   FORBIDDEN_403 - any other error, the client is not allowed to make the request
+** The message of the error is returned as the detail of the error response, so it must not contain anything that
+**   should not be sent to the client.
+**
+** NOTE: The health and readiness checks are answered before the authorizers are called, so the orchestrators do not
+**   need credentials.
+ */
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+var authorizersMutex sync.RWMutex
+var authorizers []func(*http.Request) error
+
+/*
+** Adds the authorizer to the end of the list that is called for each request.
+ */
+func RegisterAuthorizer(authorizer func(*http.Request) error) {
+	authorizersMutex.Lock()
+	authorizers = append(authorizers, authorizer)
+	authorizersMutex.Unlock()
+}
+
+/*
+** Calls the registered authorizers for the request. Returns false if one of them rejected the request, in which
+**   case the error response has already been written.
+ */
+func authorizeRequest(w http.ResponseWriter, r *http.Request) bool {
+	authorizersMutex.RLock()
+	registered := authorizers
+	authorizersMutex.RUnlock()
+
+	for _, authorizer := range registered {
+		err := authorizer(r)
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, ErrUnauthenticated) {
+			// UNAUTHORIZED_401
+			writeError(w, http.StatusUnauthorized, err.Error())
+		} else {
+			// FORBIDDEN_403
+			writeError(w, http.StatusForbidden, err.Error())
+		}
+		return false
+	}
+
+	return true
+}
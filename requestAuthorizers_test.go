@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+** Registers the authorizer for the duration of the test.
+ */
+func registerAuthorizerForTest(t *testing.T, authorizer func(*http.Request) error) {
+	t.Helper()
+
+	authorizersMutex.Lock()
+	original := authorizers
+	authorizersMutex.Unlock()
+	t.Cleanup(func() {
+		authorizersMutex.Lock()
+		authorizers = original
+		authorizersMutex.Unlock()
+	})
+
+	RegisterAuthorizer(authorizer)
+}
+
+/*
+** A custom authorizer that rejects one path: the other requests are dispatched, and the health check is answered
+**   without calling the authorizers.
+ */
+func TestAuthorizerRejectsOnePath(t *testing.T) {
+	registerAuthorizerForTest(t, func(r *http.Request) error {
+		switch {
+		case r.URL.Path == "/stats":
+			return errors.New("stats are restricted")
+		case r.URL.Path == "/capabilities" && r.Header.Get("Authorization") == "":
+			return fmt.Errorf("no credentials: %w", ErrUnauthenticated)
+		}
+		return nil
+	})
+
+	w := request(http.MethodGet, "/stats", "")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "stats are restricted") {
+		t.Errorf("GET /stats: status %d, body %q, want %d", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+
+	if w := request(http.MethodGet, "/capabilities", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /capabilities without credentials: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	r := newRequest(http.MethodGet, "/capabilities", "")
+	r.Header.Set("Authorization", "Bearer token")
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("GET /capabilities with credentials: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if w := request(http.MethodPost, "/hash", "password=angryMonkey"); w.Code != http.StatusOK {
+		t.Errorf("POST /hash: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// the health check never calls the authorizers
+	registerAuthorizerForTest(t, func(*http.Request) error { return ErrUnauthenticated })
+	if w := request(http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /health: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+** Each request that is dispatched by the central handler is logged as a single structured line (with log/slog) once
+**   the sub-handler has completed:
+**     time=... level=INFO msg=request method=POST path=/hash status=200 bytes=2 duration=41.3µs client_ip=::1
+** Only the path is logged (not the query string or the form data) so that the passwords passed to POST /hash never
+**   end up in the log. The requests are logged at the info level, so setting the -log-level flag to warn or error
+**   turns the request log off. The level is parsed by initializeRequestLogger() (called from main()).
+ */
+var requestLogLevel = "info"
+var requestLogger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+/*
+** Creates the requestLogger with the level from the requestLogLevel. Returns an error if the level is not one of
+**   debug, info, warn or error.
+ */
+func initializeRequestLogger() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(requestLogLevel)); err != nil {
+		return err
+	}
+
+	requestLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	return nil
+}
+
+/*
+** Logs the method, path, status, number of body bytes written and duration of the request.
+ */
+func logRequest(r *http.Request, status int, bytes int64, start time.Time) {
+	if !requestLogger.Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+
+	requestLogger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.Int64("bytes", bytes),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("client_ip", clientIP(r)),
+	)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Each request is logged as one line with its method, path, status, bytes, duration and client IP. The query string
+**   and the form data (the password) are never logged, and -log-level=warn turns the request log off.
+ */
+func TestRequestLogging(t *testing.T) {
+	setForTest(t, &hashDelay, 0)
+	setForTest(t, &requestLogger, requestLogger)
+	setForTest(t, &requestLogLevel, "info")
+
+	var w *httptest.ResponseRecorder
+	logged := captureStderr(t, func() {
+		// the logger is created here so that it writes to the captured os.Stderr
+		if err := initializeRequestLogger(); err != nil {
+			t.Errorf("initializeRequestLogger: %v", err)
+		}
+		w = request(http.MethodPost, "/hash?token=secret", "password=angryMonkey")
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /hash: status %d", w.Code)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(logged, "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1:\n%s", len(lines), logged)
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(lines[0]) {
+		if key, value, found := strings.Cut(field, "="); found {
+			fields[key] = value
+		}
+	}
+	for key, want := range map[string]string{
+		"level":     "INFO",
+		"msg":       "request",
+		"method":    "POST",
+		"path":      "/hash",
+		"status":    "200",
+		"bytes":     fmt.Sprint(w.Body.Len()),
+		"client_ip": "192.0.2.1",
+	} {
+		if fields[key] != want {
+			t.Errorf("logged %s=%q, want %q in %q", key, fields[key], want, lines[0])
+		}
+	}
+	if duration, err := time.ParseDuration(fields["duration"]); err != nil || duration <= 0 {
+		t.Errorf("logged duration %q, want a positive duration", fields["duration"])
+	}
+	if strings.Contains(logged, "secret") || strings.Contains(logged, "angryMonkey") {
+		t.Errorf("the query string or the password was logged: %q", lines[0])
+	}
+
+	requestLogLevel = "warn"
+	logged = captureStderr(t, func() {
+		if err := initializeRequestLogger(); err != nil {
+			t.Errorf("initializeRequestLogger: %v", err)
+		}
+		request(http.MethodGet, "/stats", "")
+	})
+	if logged != "" {
+		t.Errorf("-log-level=warn logged %q, want nothing", logged)
+	}
+}
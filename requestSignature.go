@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+** When the signatureSecret is set (via the -hmac-secret flag), every request must carry an HMAC-SHA256 signature
+**   in the X-Signature header. The signature is computed over the HTTP verb, the URL path and the timestamp from the
+**   X-Signature-Timestamp header (Unix seconds), each separated by a newline, and is hex encoded:
+**     hex(HMAC-SHA256(secret, "<verb>\n<path>\n<timestamp>"))
+** The timestamp must be within signatureMaxSkew of the server's clock so that a captured request cannot be
+**   replayed later. Requests that fail the check are rejected with UNAUTHORIZED_401.
+** The health and readiness checks do not need a signature, so the orchestrators can probe the server without the
+**   shared secret (the same as they do not need to get past the authorizers).
+ */
+var signatureSecret = ""
+var signatureMaxSkew = 5 * time.Minute
+
+const SignatureHeader = "X-Signature"
+const SignatureTimestampHeader = "X-Signature-Timestamp"
+
+/*
+** This wraps the passed in handler so that the request signature is verified prior to calling it. If there is no
+**   signatureSecret configured, the requests are passed straight through.
+ */
+func requireSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		probe := isHealthPath(r.URL.Path) || r.URL.Path == ReadinessPath
+		if signatureSecret != "" && !probe && !validSignature(r, time.Now()) {
+			// UNAUTHORIZED_401
+			writeError(w, http.StatusUnauthorized, "")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+/*
+** Checks that the timestamp is within the allowed clock skew and that the signature matches the one computed with
+**   the shared secret.
+ */
+func validSignature(r *http.Request, now time.Time) bool {
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return false
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(signature, computeSignature(r.Method, r.URL.Path, timestamp))
+}
+
+/*
+** Returns the HMAC-SHA256 of the verb, path and timestamp using the signatureSecret.
+ */
+func computeSignature(verb string, path string, timestamp string) []byte {
+	mac := hmac.New(sha256.New, []byte(signatureSecret))
+	mac.Write([]byte(verb + "\n" + path + "\n" + timestamp))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+** Builds a GET /stats request signed with the secret at the time.
+ */
+func signedStatsRequest(secret string, at time.Time) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("GET\n/stats\n" + timestamp))
+
+	r := newRequest(http.MethodGet, "/stats", "")
+	r.Header.Set(SignatureTimestampHeader, timestamp)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+/*
+** With -hmac-secret, a request with a valid signature is dispatched, while one with a timestamp outside of the allowed
+**   skew, a signature made with another secret or no signature at all gets UNAUTHORIZED_401.
+ */
+func TestRequestSignature(t *testing.T) {
+	setForTest(t, &signatureSecret, "s3cret")
+
+	if w := serve(signedStatsRequest("s3cret", time.Now())); w.Code != http.StatusOK {
+		t.Errorf("valid signature: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for name, r := range map[string]*http.Request{
+		"expired timestamp": signedStatsRequest("s3cret", time.Now().Add(-signatureMaxSkew-time.Minute)),
+		"future timestamp":  signedStatsRequest("s3cret", time.Now().Add(signatureMaxSkew+time.Minute)),
+		"bad signature":     signedStatsRequest("other", time.Now()),
+		"no signature":      newRequest(http.MethodGet, "/stats", ""),
+	} {
+		if w := serve(r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+/*
+** With -hmac-secret, the health and readiness checks are answered without a signature so that the orchestrators
+**   can probe the server. The other requests still need one.
+ */
+func TestSignatureNotRequiredForProbes(t *testing.T) {
+	setForTest(t, &signatureSecret, "s3cret")
+
+	for _, path := range append([]string{healthPath, ReadinessPath}, healthPathAliases...) {
+		if w := request(http.MethodGet, path, ""); w.Code != http.StatusOK {
+			t.Errorf("unsigned GET %s: status %d, want %d", path, w.Code, http.StatusOK)
+		}
+	}
+	if w := request(http.MethodGet, "/stats", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned GET /stats: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
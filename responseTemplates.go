@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"text/template"
+)
+
+/*
+** The JSON responses can be wrapped in a client specific envelope by setting the -success-template and/or the
+**   -error-template flags to a Go text/template. The success template is used for the responses with a status
+**   below 400 and the error template for the rest. The template is executed with a responseTemplateData, for
+**   example:
+**     -success-template '{"ok": true, "status": {{.Status}}, "data": {{.Body}}}'
+** When a template is not set, the response is the JSON body on its own (the default behavior).
+**
+** When the success template is set, POST /hash returns the identifier as the JSON {"id": "<identifier>"} so that it
+**   is wrapped like the other responses.
+**
+** NOTE: The templates only apply to the JSON responses. The hashed password returned by
+**   GET /hash/<identifier>?format=text (or format=jwt) is plain text.
+ */
+var successTemplateText = ""
+var errorTemplateText = ""
+
+var successTemplate *template.Template
+var errorTemplate *template.Template
+
+/*
+** The responseTemplateData is what the response templates are executed with. The Body is the JSON encoding of the
+**   Payload (what the response would have been without a template).
+ */
+type responseTemplateData struct {
+	Status  int
+	Payload interface{}
+	Body    string
+}
+
+/*
+** Parses the response templates and checks that they can be executed. This is called from main() so that a bad
+**   template stops the server at startup rather than failing each response.
+** The check executes the template with an empty Payload, which catches the references to the fields that the
+**   responseTemplateData does not have. A missing key of the Payload (i.e. {{.Payload.id}}, which only some of the
+**   responses have) is not an error, it is replaced by its zero value.
+ */
+func initializeResponseTemplates() error {
+	var err error
+
+	successTemplate, err = parseResponseTemplate("success", successTemplateText, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	errorTemplate, err = parseResponseTemplate("error", errorTemplateText, http.StatusInternalServerError)
+	return err
+}
+
+func parseResponseTemplate(name string, text string, sampleStatus int) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := responseTemplateData{Status: sampleStatus, Payload: map[string]string{}, Body: "{}"}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+/*
+** Returns the body for a JSON response with the status. If there is no template for the status, the body is returned
+**   unchanged.
+ */
+func applyResponseTemplate(status int, payload interface{}, body []byte) ([]byte, error) {
+	tmpl := successTemplate
+	if status >= http.StatusBadRequest {
+		tmpl = errorTemplate
+	}
+	if tmpl == nil {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, responseTemplateData{Status: status, Payload: payload, Body: string(body)}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+/*
+** A template that uses a key of the Payload is valid (the key is only present in some of the responses), while a
+**   reference to a field the responseTemplateData does not have is rejected at startup.
+ */
+func TestParseResponseTemplate(t *testing.T) {
+	if _, err := parseResponseTemplate("success", `{"id":"{{.Payload.id}}","data":{{.Body}}}`, http.StatusOK); err != nil {
+		t.Errorf("template with {{.Payload.id}}: %v", err)
+	}
+	if _, err := parseResponseTemplate("success", `{"data":{{.Missing}}}`, http.StatusOK); err == nil {
+		t.Errorf("template with {{.Missing}}: no error")
+	}
+	if _, err := parseResponseTemplate("success", `{"data":{{.Body}`, http.StatusOK); err == nil {
+		t.Errorf("template that does not parse: no error")
+	}
+}
+
+/*
+** With a -success-template, the identifier returned by POST /hash is JSON and is wrapped in the template.
+ */
+func TestPostHashIdentifierIsTemplated(t *testing.T) {
+	tmpl, err := parseResponseTemplate("success", `{"ok":true,"id":"{{.Payload.id}}","data":{{.Body}}}`, http.StatusOK)
+	if err != nil {
+		t.Fatalf("parseResponseTemplate: %v", err)
+	}
+	setForTest(t, &successTemplate, tmpl)
+
+	w := request(http.MethodPost, "/hash", "password=angryMonkey")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("POST /hash: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var response struct {
+		Ok   bool              `json:"ok"`
+		Id   string            `json:"id"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("POST /hash body %q: %v", w.Body.String(), err)
+	}
+	if !response.Ok || response.Id == "" || response.Data["id"] != response.Id {
+		t.Errorf("POST /hash body %q is not wrapped in the template", w.Body.String())
+	}
+}
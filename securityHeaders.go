@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+/*
+** The following control which security headers are added to every response. Each can be turned off with its flag:
+**   -header-nosniff - X-Content-Type-Options: nosniff
+**   -header-frame-deny - X-Frame-Options: DENY
+**   -hsts-max-age - Strict-Transport-Security: max-age=<seconds> (0 disables the header)
+** The Strict-Transport-Security header is only sent on requests that arrived over TLS since browsers ignore it on
+**   plaintext connections.
+ */
+var nosniffHeaderEnabled = true
+var frameDenyHeaderEnabled = true
+var hstsMaxAge = 31536000
+
+/*
+** This wraps the passed in handler so that the security headers are set prior to calling it. The headers need to
+**   be set before the handler writes anything since writing the body commits the headers.
+ */
+func securityHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nosniffHeaderEnabled {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if frameDenyHeaderEnabled {
+			w.Header().Set("X-Frame-Options", "DENY")
+		}
+		if hstsMaxAge > 0 && r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(hstsMaxAge))
+		}
+
+		next(w, r)
+	}
+}
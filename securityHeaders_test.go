@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+/*
+** The nosniff and frame headers are on every response, and the Strict-Transport-Security header is only on the
+**   responses to the requests that arrived over TLS. Each header can be turned off.
+ */
+func TestSecurityHeaders(t *testing.T) {
+	setForTest(t, &hstsMaxAge, 600)
+
+	w := request(http.MethodGet, "/stats", "")
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("GET /stats: headers %v, want X-Content-Type-Options: nosniff and X-Frame-Options: DENY", w.Header())
+	}
+	if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "" {
+		t.Errorf("GET /stats over plaintext: Strict-Transport-Security %q, want none", hsts)
+	}
+
+	r := newRequest(http.MethodGet, "/stats", "")
+	r.TLS = &tls.ConnectionState{}
+	if hsts := serve(r).Header().Get("Strict-Transport-Security"); hsts != "max-age=600" {
+		t.Errorf("GET /stats over TLS: Strict-Transport-Security %q, want max-age=600", hsts)
+	}
+
+	setForTest(t, &nosniffHeaderEnabled, false)
+	setForTest(t, &frameDenyHeaderEnabled, false)
+	setForTest(t, &hstsMaxAge, 0)
+	r = newRequest(http.MethodGet, "/stats", "")
+	r.TLS = &tls.ConnectionState{}
+	w = serve(r)
+	for _, header := range []string{"X-Content-Type-Options", "X-Frame-Options", "Strict-Transport-Security"} {
+		if value := w.Header().Get(header); value != "" {
+			t.Errorf("GET /stats with the headers turned off: %s %q, want none", header, value)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+** When the stateFile is set (via the -state-file flag), the hashed passwords are saved to the file so that a restart
+**   of the server does not lose them. The file is newline-delimited JSON with one stateRecord per line. A record is
+**   appended each time a hash is saved or deleted (in the same order as the updates to the map, see
+**   releaseAndAppendStateRecords()), and the records are replayed into the map by initializeHash() at startup. A
+**   missing file is treated as empty.
+** Since the records for the deleted and evicted hashes would otherwise pile up forever, the file is compacted each
+**   time it is loaded: it is rewritten with a single record for each of the loaded hashes (to a temporary file that
+**   then replaces it, so a crash part way through leaves the original file).
+** The count is moved past the largest identifier in the file so that the new POST /hash requests do not reuse the
+**   identifiers of the saved hashes.
+ */
+var stateFile = ""
+var stateFileWriter *os.File
+
+/*
+** The stateFileMutex serializes the writes to the stateFileWriter. It is separate from the passwordMutex so that a
+**   slow disk does not hold up the other writers of the map. The records are queued on the pendingStateRecords
+**   (which is protected by the passwordMutex) in the same order as the updates to the map, and are then written
+**   from the queue in batches with only the stateFileMutex held.
+ */
+var stateFileMutex sync.Mutex
+var pendingStateRecords []stateRecord
+
+type stateRecord struct {
+	Id        int64  `json:"id"`
+	Algorithm string `json:"algo,omitempty"`
+	Salt      string `json:"salt,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Pepper    string `json:"pepper,omitempty"`
+	Stored    int64  `json:"stored,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+/*
+** Loads the hashed passwords from the stateFile into the map, compacts the file and opens it to append the new
+**   records. A line that cannot be parsed (i.e. a partial line written when the server crashed) or that has an algo
+**   that is not one of the hashAlgorithms (or bcrypt) is logged and skipped. The bcrypt hashes are loaded even when
+**   bcrypt is no longer the -hash-scheme, so they can still be verified.
+ */
+func loadStateFile() error {
+	loaded := make(map[int64]storedHash)
+	now := time.Now()
+	var largestIdentifier int64 = 0
+
+	file, err := os.Open(stateFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			var record stateRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Printf("loadStateFile: skipping line %d of %s: %v", line, stateFile, err)
+				continue
+			}
+
+			// The records written before the algorithm could be selected were all hashed with the default
+			if record.Algorithm == "" {
+				record.Algorithm = DefaultHashAlgorithm
+			}
+
+			if record.Deleted {
+				delete(loaded, record.Id)
+			} else if _, found := hashAlgorithms[record.Algorithm]; !found && record.Algorithm != BcryptHashAlgorithm {
+				// i.e. a record written by a later version with an algorithm this one does not have
+				log.Printf("loadStateFile: skipping line %d of %s: unsupported algo %q", line, stateFile,
+					record.Algorithm)
+				continue
+			} else if digest, err := base64.StdEncoding.DecodeString(record.Hash); err != nil {
+				log.Printf("loadStateFile: skipping line %d of %s: %v", line, stateFile, err)
+				continue
+			} else if salt, err := base64.StdEncoding.DecodeString(record.Salt); err != nil {
+				log.Printf("loadStateFile: skipping line %d of %s: %v", line, stateFile, err)
+				continue
+			} else {
+				// The records written before the stored time was kept are treated as stored now
+				stored := now
+				if record.Stored != 0 {
+					stored = time.Unix(record.Stored, 0)
+				}
+				// The records written before the hashes were salted have no salt (or pepper id)
+				loaded[record.Id] = storedHash{algorithm: record.Algorithm, salt: salt, digest: digest,
+					pepperId: record.Pepper, stored: stored}
+			}
+
+			if record.Id > largestIdentifier {
+				largestIdentifier = record.Id
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := compactStateFile(loaded, largestIdentifier); err != nil {
+		return err
+	}
+
+	stateFileWriter, err = os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	passwordMutex.Lock()
+	hashedPasswords.Store(&passwordSnapshot{base: loaded, recent: make(map[int64]storedHash)})
+	passwordMutex.Unlock()
+
+	mu.Lock()
+	if largestIdentifier > int64(count) && largestIdentifier <= MaximumIdentifier {
+		count = int(largestIdentifier)
+	}
+	mu.Unlock()
+
+	log.Printf("loadStateFile: loaded %d hashed passwords from %s", len(loaded), stateFile)
+	return nil
+}
+
+/*
+** Rewrites the stateFile with one record for each of the loaded hashes (in identifier order). If the largest
+**   identifier in the file is not one of them (it was deleted), a deleted record is kept for it so that the count
+**   is still moved past it on the next load. The records are written to a temporary file in the same directory,
+**   which is synced and then renamed over the stateFile.
+ */
+func compactStateFile(loaded map[int64]storedHash, largestIdentifier int64) error {
+	identifiers := make([]int64, 0, len(loaded))
+	for identifier := range loaded {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Slice(identifiers, func(i, j int) bool { return identifiers[i] < identifiers[j] })
+
+	records := make([]stateRecord, 0, len(identifiers)+1)
+	for _, identifier := range identifiers {
+		entry := loaded[identifier]
+		records = append(records, stateRecord{
+			Id:        identifier,
+			Algorithm: entry.algorithm,
+			Salt:      base64.StdEncoding.EncodeToString(entry.salt),
+			Hash:      base64.StdEncoding.EncodeToString(entry.digest),
+			Pepper:    entry.pepperId,
+			Stored:    entry.stored.Unix(),
+		})
+	}
+	if _, found := loaded[largestIdentifier]; !found && largestIdentifier > 0 {
+		records = append(records, stateRecord{Id: largestIdentifier, Deleted: true})
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(stateFile), filepath.Base(stateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temporary.Name()) }()
+
+	writer := bufio.NewWriter(temporary)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			_ = temporary.Close()
+			return err
+		}
+		_, _ = writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary.Name(), stateFile)
+}
+
+/*
+** Queues the records, releases the passwordMutex and then writes the queued records to the stateFile. This must be
+**   called with the passwordMutex held, right after the update to the map that the records are for.
+** The queue is taken with the stateFileMutex held, so the records are written in the same order as they were
+**   queued. The records of a caller may be written by an earlier caller that took the queue first, but that caller
+**   holds the stateFileMutex until they are written, so the records are always in the file once this returns.
+ */
+func releaseAndAppendStateRecords(records ...stateRecord) {
+	if stateFileWriter == nil {
+		passwordMutex.Unlock()
+		return
+	}
+	pendingStateRecords = append(pendingStateRecords, records...)
+	passwordMutex.Unlock()
+
+	stateFileMutex.Lock()
+	defer stateFileMutex.Unlock()
+
+	passwordMutex.Lock()
+	batch := pendingStateRecords
+	pendingStateRecords = nil
+	passwordMutex.Unlock()
+
+	for _, record := range batch {
+		appendStateRecord(record)
+	}
+}
+
+/*
+** Appends the record to the stateFile. This must be called with the stateFileMutex held. If there is no stateFile,
+**   this does nothing.
+ */
+func appendStateRecord(record stateRecord) {
+	if stateFileWriter == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "appendStateRecord(1) Marshal: %v\n", err)
+		return
+	}
+
+	if _, err := stateFileWriter.Write(append(line, '\n')); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "appendStateRecord(2) Write: %v\n", err)
+	}
+}
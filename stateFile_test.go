@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Loads the lines as the -state-file for the test. The hashed passwords and the stateFile are put back once the test
+**   is done.
+ */
+func loadStateFileForTest(t *testing.T, lines string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	original := hashedPasswords.Load()
+	setForTest(t, &stateFile, path)
+	t.Cleanup(func() {
+		if stateFileWriter != nil {
+			_ = stateFileWriter.Close()
+			stateFileWriter = nil
+		}
+		passwordMutex.Lock()
+		hashedPasswords.Store(original)
+		passwordMutex.Unlock()
+	})
+
+	if err := loadStateFile(); err != nil {
+		t.Fatalf("loadStateFile: %v", err)
+	}
+	return path
+}
+
+/*
+** A record with an algo that is not one of the hashAlgorithms is skipped rather than loaded (computing the hash with
+**   it would panic).
+ */
+func TestLoadStateFileSkipsUnsupportedAlgorithm(t *testing.T) {
+	loadStateFileForTest(t, `{"id":1,"algo":"sha256","salt":"c2FsdA==","hash":"ZGlnZXN0"}
+{"id":2,"algo":"md4","salt":"c2FsdA==","hash":"ZGlnZXN0"}
+{"id":3,"salt":"c2FsdA==","hash":"ZGlnZXN0"}
+`)
+
+	if entry, found := getHashedPassword(1); !found || entry.algorithm != "sha256" {
+		t.Errorf("identifier 1: found %v, algorithm %q, want sha256", found, entry.algorithm)
+	}
+	if _, found := getHashedPassword(2); found {
+		t.Errorf("identifier 2 with an unsupported algo was loaded")
+	}
+	if entry, found := getHashedPassword(3); !found || entry.algorithm != DefaultHashAlgorithm {
+		t.Errorf("identifier 3: found %v, algorithm %q, want %s", found, entry.algorithm, DefaultHashAlgorithm)
+	}
+}
+
+/*
+** Loading the stateFile compacts it to one record per hash. The deleted hashes (and the partial last line) are dropped,
+**   except for a deleted record for the largest identifier so that it is not handed out again.
+ */
+func TestLoadStateFileCompacts(t *testing.T) {
+	path := loadStateFileForTest(t, `{"id":1,"algo":"sha256","salt":"c2FsdA==","hash":"ZGlnZXN0","stored":1700000000}
+{"id":2,"algo":"sha512","salt":"c2FsdA==","hash":"ZGlnZXN0","stored":1700000000}
+{"id":1,"deleted":true}
+{"id":3,"algo":"sha512","salt":"c2FsdA==","hash":"ZGlnZXN0","stored":1700000000}
+{"id":3,"deleted":true}
+{"id":4,"algo":"sha5`)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	want := `{"id":2,"algo":"sha512","salt":"c2FsdA==","hash":"ZGlnZXN0","stored":1700000000}
+{"id":3,"deleted":true}
+`
+	if string(contents) != want {
+		t.Errorf("compacted state file:\n%s\nwant:\n%s", contents, want)
+	}
+
+	// the new records are appended after the compacted ones
+	setHashedPassword(testIdentifierBase, testStoredHash(testIdentifierBase))
+	t.Cleanup(func() { removeHashedPassword(testIdentifierBase) })
+	contents, _ = os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n"); len(lines) != 3 ||
+		!strings.HasPrefix(lines[2], fmt.Sprintf(`{"id":%d,`, testIdentifierBase)) {
+		t.Errorf("state file after the append:\n%s", contents)
+	}
+}
+
+/*
+** The record is written to the stateFile after the passwordMutex is released, so a write that is stuck on the disk
+**   (here, on the stateFileMutex) does not hold up the other writers of the map. The record is still written once
+**   the stateFileMutex is free.
+ */
+func TestStateFileWriteOutsidePasswordMutex(t *testing.T) {
+	path := loadStateFileForTest(t, "")
+	t.Cleanup(func() { removeHashedPassword(testIdentifierBase) })
+
+	stateFileMutex.Lock()
+	saved := make(chan struct{})
+	go func() {
+		setHashedPassword(testIdentifierBase, testStoredHash(testIdentifierBase))
+		close(saved)
+	}()
+
+	for {
+		if _, found := getHashedPassword(testIdentifierBase); found {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The setHashedPassword() is now waiting for the stateFileMutex, and must have released the passwordMutex
+	deadline := time.Now().Add(time.Second)
+	for !passwordMutex.TryLock() {
+		if time.Now().After(deadline) {
+			stateFileMutex.Unlock()
+			t.Fatalf("the passwordMutex is held while the record is waiting to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	passwordMutex.Unlock()
+	select {
+	case <-saved:
+		t.Fatalf("setHashedPassword() returned before the record was written")
+	default:
+	}
+
+	stateFileMutex.Unlock()
+	<-saved
+	contents, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(contents), fmt.Sprintf(`{"id":%d,`, testIdentifierBase)) {
+		t.Errorf("state file after the write:\n%s", contents)
+	}
+}
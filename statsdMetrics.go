@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+** When the statsdAddress is set (via the -statsd-addr flag, i.e. "localhost:8125"), the server sends its metrics to
+**   a StatsD daemon over UDP. Each metric is sent as its own packet as soon as it is recorded:
+**     go_server.requests.<verb>.<status>:1|c - a counter for every request dispatched by the central handler
+**     go_server.hash.latency:<milliseconds>|ms - a timer for every POST /hash that was handed an identifier (the
+**       same time that is included in GET /stats)
+** The packets are fire-and-forget, so a StatsD daemon that is down or slow never holds up a request. When there is
+**   no statsdAddress, nothing is sent.
+ */
+var statsdAddress = ""
+var statsdConn net.Conn
+
+const StatsdPrefix = "go_server."
+
+/*
+** The verb in the request counter comes from the client, so only the standard HTTP verbs are used as is. Any other
+**   verb is counted as StatsdOtherVerb, so that a client cannot create new metrics at will or inject its own StatsD
+**   lines (with a verb that has a '|', ':' or newline in it).
+ */
+const StatsdOtherVerb = "other"
+
+var statsdVerbs = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+/*
+** Opens the UDP socket to the statsdAddress. Since UDP is connectionless, this only fails if the address cannot be
+**   resolved. If there is no statsdAddress, this does nothing.
+ */
+func initializeStatsd() error {
+	if statsdAddress == "" {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", statsdAddress)
+	if err != nil {
+		return err
+	}
+
+	statsdConn = conn
+	return nil
+}
+
+/*
+** Sends the counter for a request that was dispatched by the central handler.
+ */
+func statsdRequest(verb string, status int) {
+	if !statsdVerbs[verb] {
+		verb = StatsdOtherVerb
+	}
+	sendStatsdMetric(fmt.Sprintf("requests.%s.%d:1|c", strings.ToLower(verb), status))
+}
+
+/*
+** Sends the timer for a POST /hash request.
+ */
+func statsdHashLatency(elapsed time.Duration) {
+	sendStatsdMetric(fmt.Sprintf("hash.latency:%.3f|ms", float64(elapsed)/float64(time.Millisecond)))
+}
+
+/*
+** Sends a single metric (without the StatsdPrefix) to the StatsD daemon. The write errors are ignored rather than
+**   logged, since a StatsD daemon that is not running makes every write fail (with "connection refused") and the
+**   log would be flooded with them.
+ */
+func sendStatsdMetric(metric string) {
+	if statsdConn == nil {
+		return
+	}
+
+	_, _ = statsdConn.Write([]byte(StatsdPrefix + metric))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+** Points the StatsD metrics at a UDP listener for the duration of the test and returns the listener.
+ */
+func listenForStatsd(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	setForTest(t, &statsdAddress, listener.LocalAddr().String())
+	setForTest(t, &statsdConn, nil)
+	if err := initializeStatsd(); err != nil {
+		t.Fatalf("initializeStatsd: %v", err)
+	}
+	t.Cleanup(func() { _ = statsdConn.Close() })
+
+	return listener
+}
+
+/*
+** Reads the packets from the listener until one starts with the prefix (or a second passes) and returns it.
+ */
+func readStatsdPacket(t *testing.T, listener net.PacketConn, prefix string) string {
+	t.Helper()
+
+	buffer := make([]byte, 1024)
+	_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("no %s packet received: %v", prefix, err)
+		}
+		if packet := string(buffer[:n]); strings.HasPrefix(packet, prefix) {
+			return packet
+		}
+	}
+}
+
+/*
+** Each dispatched request sends a counter for its verb and status, and each POST /hash sends a timer.
+ */
+func TestStatsdMetrics(t *testing.T) {
+	listener := listenForStatsd(t)
+
+	request(http.MethodGet, "/stats", "")
+	if packet := readStatsdPacket(t, listener, "go_server.requests."); packet != "go_server.requests.get.200:1|c" {
+		t.Errorf("request counter %q, want %q", packet, "go_server.requests.get.200:1|c")
+	}
+
+	postHash(t, "password=angryMonkey")
+	if packet := readStatsdPacket(t, listener, "go_server.hash.latency:"); !strings.HasSuffix(packet, "|ms") {
+		t.Errorf("hash latency timer %q, want a |ms timer", packet)
+	}
+	if packet := readStatsdPacket(t, listener, "go_server.requests."); packet != "go_server.requests.post.200:1|c" {
+		t.Errorf("request counter %q, want %q", packet, "go_server.requests.post.200:1|c")
+	}
+}
+
+/*
+** A verb that is not one of the standard HTTP verbs is counted as "other", so it can neither add a metric nor
+**   inject a StatsD line of its own.
+ */
+func TestStatsdUnknownVerb(t *testing.T) {
+	listener := listenForStatsd(t)
+
+	for _, verb := range []string{"BREW", "GET|c\ngo_server.injected:1", "x:1"} {
+		statsdRequest(verb, http.StatusMethodNotAllowed)
+		packet := readStatsdPacket(t, listener, "go_server.requests.")
+		if packet != "go_server.requests.other.405:1|c" {
+			t.Errorf("request counter for the verb %q: %q, want %q", verb, packet, "go_server.requests.other.405:1|c")
+		}
+	}
+
+	request("BREW", "/stats", "")
+	if packet := readStatsdPacket(t, listener, "go_server.requests."); packet != "go_server.requests.other.405:1|c" {
+		t.Errorf("request counter for BREW /stats: %q, want %q", packet, "go_server.requests.other.405:1|c")
+	}
+}